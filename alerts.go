@@ -1,8 +1,11 @@
 package main
 
 import (
-	"net/url"
+	"context"
+	"fmt"
+	"io"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/bugsnag/bugsnag-go/v2"
@@ -26,77 +29,192 @@ func (alert Alert) Hash() string {
 	return strconv.FormatUint(hash, 10)
 }
 
-func (alert Alert) GeneratePictures(generatorQuery url.Values) ([]SlackImage, error) {
-	var alertFormula string
-	for key, param := range generatorQuery {
-		if key == "g0.expr" {
-			alertFormula = param[0]
-			break
+// GeneratePictures renders and uploads a graph per plot expression, or a
+// single image with a panel per expression when composite graphs are
+// enabled. The other panels of the generator URL are graphed after the
+// alert expression, for context. Alerts linked to a Grafana panel get the
+// panel rendered by Grafana instead, when it can. Notes explain graphs that
+// are missing or drawn without a threshold.
+func (alert Alert) GeneratePictures(ctx context.Context, link GeneratorLink) ([]SlackImage, []string, error) {
+	generatorPanels := append([]GeneratorPanel{}, link.Panels...)
+	if len(generatorPanels) == 0 {
+		generatorPanels = []GeneratorPanel{{Expr: alert.Expression(link)}}
+	}
+
+	opts := alert.PlotOptions()
+	if opts.Disabled {
+		clog.Infof("Graphs disabled for alert %s", alert.Labels["alertname"])
+		return nil, nil, nil
+	}
+	if opts.Expr != "" {
+		clog.Infof("Graphing expression from annotation: %s", opts.Expr)
+		generatorPanels[0].Expr = opts.Expr
+	}
+
+	queryTime, duration := alert.plotTimeRange(opts)
+	titleTemplate := ExpandLabels(opts.Title, alert.Labels)
+
+	if panel, ok := alert.GrafanaPanel(); ok && viper.GetString("grafana_url") != "" {
+		title := titleTemplate
+		if title == "" {
+			title = alert.Labels["alertname"]
+		}
+
+		image, err := NewGrafanaClient().RenderPanel(ctx, panel, queryTime, duration)
+		if err == nil {
+			clog.Infof("Rendered Grafana panel %s of dashboard %s", panel.PanelID, panel.DashboardUID)
+			graph, err := uploadGraph(title, image)
+			if err != nil {
+				return nil, nil, err
+			}
+			return []SlackImage{graph}, nil, nil
 		}
+
+		// fall back to drawing the graph
+		err = errors.Wrap(err, "Grafana render error")
+		_ = bugsnag.Notify(err,
+			bugsnag.MetaData{
+				"Grafana": {
+					"DashboardUID": panel.DashboardUID,
+					"PanelID":      panel.PanelID,
+				},
+			})
+		clog.Warn(err.Error())
 	}
 
-	plotExpression := GetPlotExpr(alertFormula)
-	queryTime, duration := alert.GetPlotTimeRange()
+	var notes []string
+	var plotExpressions int
+	datasource := alert.Datasource
+	siblings := alert.SiblingThresholds()
+	var panels []Panel
+	for _, generatorPanel := range generatorPanels {
+		if strings.TrimSpace(generatorPanel.Expr) == "" {
+			clog.Infof("Nothing to graph for alert %s", alert.Labels["alertname"])
+			notes = append(notes, "No expression in generator URL")
+			continue
+		}
 
-	var images []SlackImage
+		plotExpression, err := GetPlotExpr(generatorPanel.Expr)
+		if err != nil {
+			expressionParseFailures.Inc()
+			clog.Warn(err.Error())
+			notes = append(notes, fmt.Sprintf("Graph drawn without threshold: %s", err.Error()))
+		}
+		plotExpressions += len(plotExpression)
 
-	for _, expr := range plotExpression {
-		plot, err := Plot(
-			expr,
-			queryTime,
-			duration,
-			time.Duration(viper.GetInt64("metric_resolution")),
-			viper.GetString("prometheus_url"),
-			alert,
-		)
+		queryTime, duration := alert.panelTimeRange(generatorPanel, opts)
+		step := QueryStep(generatorPanel.Expr, duration)
+		for _, expr := range plotExpression {
+			expr.Unit = alert.ResolveUnit(ctx, expr.Formula, datasource)
+			expr = alert.withSiblingThresholds(expr, siblings)
+			panel, err := QueryPanel(
+				ctx,
+				expr,
+				opts,
+				queryTime,
+				duration,
+				step,
+				datasource,
+				alert,
+			)
+			if errors.Is(err, ErrNoData) {
+				graphsTotal.WithLabelValues(graphOutcomeNoData).Inc()
+				notes = append(notes, fmt.Sprintf("No data for `%s`", expr.Formula))
+				continue
+			}
+			if err != nil {
+				graphsTotal.WithLabelValues(graphOutcomeError).Inc()
+				return nil, notes, errors.Wrap(err, "Plotter error")
+			}
+			panels = append(panels, panel)
+		}
+	}
+
+	if opts.Composite && len(panels) > 1 {
+		for i := range panels {
+			panels[i].Title = panels[i].Expr.String()
+		}
+		title := titleTemplate
+		if title == "" {
+			title = alert.Labels["alertname"]
+		}
+
+		image, err := uploadPanels(title, panels...)
 		if err != nil {
-			return nil, errors.Wrap(err, "Plotter error")
+			return nil, notes, err
+		}
+		return []SlackImage{image}, notes, nil
+	}
+
+	var images []SlackImage
+	for _, panel := range panels {
+		title := panel.Expr.String()
+		if titleTemplate != "" && plotExpressions == 1 {
+			title = titleTemplate
+		} else if titleTemplate != "" {
+			title = titleTemplate + ": " + title
 		}
 
-		publicURL, err := UploadFile(viper.GetString("s3_bucket"), viper.GetString("s3_region"), plot)
+		image, err := uploadPanels(title, panel)
 		if err != nil {
-			return nil, errors.Wrap(err, "S3 error")
+			return nil, notes, err
 		}
-		clog.Infof("Graph uploaded, URL: %s", publicURL)
+		images = append(images, image)
+	}
+
+	return images, notes, nil
+}
 
-		images = append(images, SlackImage{
-			Url:   publicURL,
-			Title: expr.String(),
-		})
+// uploadPanels draws the panels into one image and uploads it.
+func uploadPanels(title string, panels ...Panel) (SlackImage, error) {
+	plot, err := PlotPanels(panels...)
+	if err != nil {
+		graphsTotal.WithLabelValues(graphOutcomeError).Inc()
+		return SlackImage{}, errors.Wrap(err, "Plotter error")
+	}
+
+	return uploadGraph(title, plot)
+}
+
+// uploadGraph uploads an image of a graph to be shown with the title.
+func uploadGraph(title string, graph io.WriterTo) (SlackImage, error) {
+	publicURL, err := UploadFile(viper.GetString("s3_bucket"), viper.GetString("s3_region"), graph)
+	if err != nil {
+		graphsTotal.WithLabelValues(graphOutcomeError).Inc()
+		return SlackImage{}, errors.Wrap(err, "S3 error")
 	}
+	graphsTotal.WithLabelValues(graphOutcomeRendered).Inc()
+	clog.Infof("Graph uploaded, URL: %s", publicURL)
 
-	return images, nil
+	return SlackImage{
+		Url:   publicURL,
+		Title: WrapTitle(title, viper.GetInt("title_wrap")),
+	}, nil
 }
 
-func (alert Alert) PostMessage(generatorQuery url.Values) error {
+func (alert Alert) PostMessage(ctx context.Context, link GeneratorLink) error {
 	clog.Warnf("Alert: channel=%s,status=%s,Labels=%v,Annotations=%v", alert.Channel, alert.Status, alert.Labels, alert.Annotations)
-	severity := alert.Labels["severity"]
 	options := make([]slack.MsgOption, 0)
 
+	queryTime, duration := alert.plotTimeRange(alert.PlotOptions())
+	alert.Links = alert.GrafanaLinks(alert.Expression(link), alert.Datasource, queryTime, duration)
+
 	attachment := slack.Attachment{}
 	attachment.Blocks.BlockSet = make([]slack.Block, 0)
-	// palette: https://bugsnag-component-library.netlify.app/?path=/docs/docs-colors--page
-	switch severity {
-	case "warn":
-		attachment.Color = "#ffa300" // sunflower
-	case "critical":
-		attachment.Color = "#ff5a60" // coral
-	case "page":
-		attachment.Color = "#a15fff" // orchid
-	}
+	attachment.Color = SeverityColor(alert.Labels["severity"])
 
 	if alert.Status == AlertStatusFiring {
 		clog.Info("Composing full message")
-		images, err := alert.GeneratePictures(generatorQuery)
+		images, notes, err := alert.GeneratePictures(ctx, link)
 		if err != nil {
 			_ = bugsnag.Notify(err,
 				bugsnag.MetaData{
 					"Alert": {
-						"GeneratorQuery": generatorQuery,
-						"Name":           alert.Labels["alertname"],
-						"GeneratorURL":   alert.GeneratorURL,
-						"Channel":        alert.Channel,
-						"MessageTS":      alert.MessageTS,
+						"GeneratorLink": link,
+						"Name":          alert.Labels["alertname"],
+						"GeneratorURL":  alert.GeneratorURL,
+						"Channel":       alert.Channel,
+						"MessageTS":     alert.MessageTS,
 					},
 				})
 		}
@@ -105,6 +223,7 @@ func (alert Alert) PostMessage(generatorQuery url.Values) error {
 			alert,
 			viper.GetString("message_template"),
 			viper.GetString("header_template"),
+			notes,
 			images...,
 		)
 		if err != nil {
@@ -122,16 +241,16 @@ func (alert Alert) PostMessage(generatorQuery url.Values) error {
 		clog.Info("Composing short update message")
 		attachment.Color = "#8cc63f" // green
 
-		images, err := alert.GeneratePictures(generatorQuery)
+		images, notes, err := alert.GeneratePictures(ctx, link)
 		if err != nil {
 			_ = bugsnag.Notify(err,
 				bugsnag.MetaData{
 					"Alert": {
-						"GeneratorQuery": generatorQuery,
-						"Name":           alert.Labels["alertname"],
-						"GeneratorURL":   alert.GeneratorURL,
-						"Channel":        alert.Channel,
-						"MessageTS":      alert.MessageTS,
+						"GeneratorLink": link,
+						"Name":          alert.Labels["alertname"],
+						"GeneratorURL":  alert.GeneratorURL,
+						"Channel":       alert.Channel,
+						"MessageTS":     alert.MessageTS,
 					},
 				})
 		}
@@ -139,6 +258,7 @@ func (alert Alert) PostMessage(generatorQuery url.Values) error {
 		messageBlocks, err := ComposeResolveUpdateBody(
 			alert,
 			viper.GetString("header_template"),
+			notes,
 			images...,
 		)
 		if err != nil {
@@ -172,23 +292,101 @@ func (alert Alert) PostMessage(generatorQuery url.Values) error {
 	}
 
 	clog.Infof("Slack message sent, channel: %s timestamp: %s", respChannel, respTimestamp)
+
+	if alert.Status == AlertStatusFiring {
+		threadTS := alert.MessageTS
+		if threadTS == "" {
+			threadTS = respTimestamp
+		}
+		alert.PostLogExcerpt(ctx, respChannel, threadTS, queryTime, duration)
+	}
 	return nil
 }
 
-func (alert Alert) GetPlotTimeRange() (time.Time, time.Duration) {
-	var queryTime time.Time
-	var duration time.Duration
-	if alert.StartsAt.Second() > alert.EndsAt.Second() {
-		queryTime = alert.StartsAt
-		duration = time.Minute * 20
-	} else {
-		queryTime = alert.EndsAt
-		duration = queryTime.Sub(alert.StartsAt)
+// SeverityColor returns the colour of a severity, empty for unknown ones.
+// palette: https://bugsnag-component-library.netlify.app/?path=/docs/docs-colors--page
+func SeverityColor(severity string) string {
+	switch severity {
+	case "warn":
+		return "#ffa300" // sunflower
+	case "critical":
+		return "#ff5a60" // coral
+	case "page":
+		return "#a15fff" // orchid
+	}
+	return ""
+}
 
-		if duration < time.Minute*20 {
-			duration = time.Minute * 20
+// Expression returns the alert expression from the first panel of the
+// generator URL, or from the rule of the alert for rulers whose generator
+// URLs don't hold it.
+func (alert Alert) Expression(link GeneratorLink) string {
+	if len(link.Panels) > 0 {
+		return link.Panels[0].Expr
+	}
+	if alert.Rule != nil {
+		return alert.Rule.Expr
+	}
+	return ""
+}
+
+// plotTimeRange returns the time range graphed for the alert, from the
+// window of its route and its lookback. The lead-in also covers the for
+// duration of the rule, when the expression was true but not firing yet.
+func (alert Alert) plotTimeRange(opts PlotOptions) (time.Time, time.Duration) {
+	window := GetPlotWindow(alert.Receiver)
+	if alert.Rule != nil {
+		window.LeadIn += alert.Rule.For
+	}
+	if lookback, ok := opts.LookbackDuration(); ok {
+		window.Min = lookback
+	}
+	return alert.GetPlotTimeRange(window, time.Now())
+}
+
+// panelTimeRange returns the time range graphed for a panel of the generator
+// URL: the range of the panel when it sets one, unless the lookback
+// annotation overrides it, else the range of the alert.
+func (alert Alert) panelTimeRange(panel GeneratorPanel, opts PlotOptions) (time.Time, time.Duration) {
+	queryTime, duration := alert.plotTimeRange(opts)
+	if _, ok := opts.LookbackDuration(); ok {
+		return queryTime, duration
+	}
+
+	if panel.Range > 0 {
+		duration = panel.Range
+	}
+	if !panel.End.IsZero() && panel.End.Before(time.Now()) {
+		queryTime = panel.End
+	}
+	return queryTime, duration
+}
+
+// GetPlotTimeRange returns the end and duration of the graph. Firing alerts
+// are graphed up to now, Alertmanager sends them with a zero or future
+// EndsAt. Resolved alerts are graphed until Tail after they ended. The
+// range starts LeadIn before the alert started and is then stretched back
+// to at least Min, or cut down to the Max before its end.
+func (alert Alert) GetPlotTimeRange(window PlotWindow, now time.Time) (time.Time, time.Duration) {
+	queryTime := now
+	if alert.Status == AlertStatusResolved && !alert.EndsAt.IsZero() && alert.EndsAt.Before(now) {
+		queryTime = alert.EndsAt.Add(window.Tail)
+		if queryTime.After(now) {
+			queryTime = now
 		}
 	}
+
+	duration := window.Min
+	if !alert.StartsAt.IsZero() && alert.StartsAt.Before(queryTime) {
+		duration = queryTime.Sub(alert.StartsAt.Add(-window.LeadIn))
+	}
+	if duration < window.Min {
+		duration = window.Min
+	}
+	if window.Max > 0 && duration > window.Max {
+		duration = window.Max
+	}
+
 	clog.Infof("Querying Time %v Duration: %v", queryTime, duration)
 	return queryTime, duration
 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetPlotTimeRange(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	window := PlotWindow{LeadIn: 10 * time.Minute, Tail: 5 * time.Minute, Min: 30 * time.Minute, Max: 6 * time.Hour}
+
+	tests := []struct {
+		name         string
+		alert        Alert
+		window       PlotWindow
+		wantEnd      time.Time
+		wantDuration time.Duration
+	}{
+		{
+			name:         "firing with zero EndsAt",
+			alert:        Alert{Status: AlertStatusFiring, StartsAt: now.Add(-time.Hour)},
+			window:       window,
+			wantEnd:      now,
+			wantDuration: time.Hour + 10*time.Minute,
+		},
+		{
+			name:         "firing with future EndsAt",
+			alert:        Alert{Status: AlertStatusFiring, StartsAt: now.Add(-time.Hour), EndsAt: now.Add(4 * time.Minute)},
+			window:       window,
+			wantEnd:      now,
+			wantDuration: time.Hour + 10*time.Minute,
+		},
+		{
+			name:         "resolved with future EndsAt",
+			alert:        Alert{Status: AlertStatusResolved, StartsAt: now.Add(-time.Hour), EndsAt: now.Add(time.Minute)},
+			window:       window,
+			wantEnd:      now,
+			wantDuration: time.Hour + 10*time.Minute,
+		},
+		{
+			name:         "resolved with tail",
+			alert:        Alert{Status: AlertStatusResolved, StartsAt: now.Add(-2 * time.Hour), EndsAt: now.Add(-time.Hour)},
+			window:       window,
+			wantEnd:      now.Add(-55 * time.Minute),
+			wantDuration: time.Hour + 15*time.Minute,
+		},
+		{
+			name:         "resolved with tail capped at now",
+			alert:        Alert{Status: AlertStatusResolved, StartsAt: now.Add(-time.Hour), EndsAt: now.Add(-2 * time.Minute)},
+			window:       window,
+			wantEnd:      now,
+			wantDuration: time.Hour + 10*time.Minute,
+		},
+		{
+			name:         "clamped to Min",
+			alert:        Alert{Status: AlertStatusFiring, StartsAt: now.Add(-5 * time.Minute)},
+			window:       window,
+			wantEnd:      now,
+			wantDuration: 30 * time.Minute,
+		},
+		{
+			name:         "clamped to Max",
+			alert:        Alert{Status: AlertStatusFiring, StartsAt: now.Add(-48 * time.Hour)},
+			window:       window,
+			wantEnd:      now,
+			wantDuration: 6 * time.Hour,
+		},
+		{
+			name:         "no Max",
+			alert:        Alert{Status: AlertStatusFiring, StartsAt: now.Add(-48 * time.Hour)},
+			window:       PlotWindow{LeadIn: 10 * time.Minute},
+			wantEnd:      now,
+			wantDuration: 48*time.Hour + 10*time.Minute,
+		},
+		{
+			name:         "zero StartsAt",
+			alert:        Alert{Status: AlertStatusFiring},
+			window:       window,
+			wantEnd:      now,
+			wantDuration: 30 * time.Minute,
+		},
+		{
+			name:         "StartsAt after now",
+			alert:        Alert{Status: AlertStatusFiring, StartsAt: now.Add(time.Minute)},
+			window:       window,
+			wantEnd:      now,
+			wantDuration: 30 * time.Minute,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			end, duration := tt.alert.GetPlotTimeRange(tt.window, now)
+			if !end.Equal(tt.wantEnd) || duration != tt.wantDuration {
+				t.Errorf("GetPlotTimeRange() = %v, %v, want %v, %v", end, duration, tt.wantEnd, tt.wantDuration)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/bugsnag/microkit/clog"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// OffsetFormula shifts every selector and subquery of a formula back in
+// time, e.g. rate(x[5m]) becomes rate(x[5m] offset 1w).
+func OffsetFormula(formula string, offset time.Duration) (string, error) {
+	expr, err := parser.ParseExpr(formula)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to parse formula")
+	}
+
+	if err := offsetNode(expr, offset); err != nil {
+		return "", err
+	}
+
+	return expr.String(), nil
+}
+
+func offsetNode(node parser.Node, offset time.Duration) error {
+	switch n := node.(type) {
+	case *parser.VectorSelector:
+		if n.OriginalOffsetExpr != nil {
+			return errors.New("can't shift selector with offset expression")
+		}
+		n.OriginalOffset += offset
+		return nil
+	case *parser.SubqueryExpr:
+		// selectors inside a subquery are evaluated relative to it
+		if n.OriginalOffsetExpr != nil {
+			return errors.New("can't shift subquery with offset expression")
+		}
+		n.OriginalOffset += offset
+		return nil
+	}
+
+	for _, child := range parser.Children(node) {
+		if err := offsetNode(child, offset); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ComparisonMetrics fetches the formula as it was offset ago, for the series
+// that are plotted. The offset formula returns the past values at the
+// evaluation times of the plotted series, so the two line up as they are.
+func ComparisonMetrics(ctx context.Context, expr PlotExpr, offset time.Duration, plotted model.Matrix, queryTime time.Time, duration, step time.Duration, datasource Datasource) (model.Matrix, error) {
+	formula, err := OffsetFormula(expr.Formula, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	clog.Infof("Querying Prometheus for comparison %s", formula)
+	metrics, _, err := Metrics(ctx, datasource, formula, queryTime, duration, step)
+	if err != nil {
+		return nil, err
+	}
+
+	return selectLike(metrics, plotted), nil
+}
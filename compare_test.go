@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/spf13/viper"
+)
+
+func TestOffsetFormula(t *testing.T) {
+	week := 7 * 24 * time.Hour
+
+	tests := []struct {
+		name    string
+		formula string
+		offset  time.Duration
+		want    string
+		wantErr bool
+	}{
+		{name: "selector", formula: "up", offset: time.Hour, want: "up offset 1h"},
+		{name: "range", formula: "rate(x[5m])", offset: week, want: "rate(x[5m] offset 1w)"},
+		{name: "existing offset", formula: "x offset 1h", offset: 24 * time.Hour, want: "x offset 1d1h"},
+		{name: "every selector", formula: "x / y", offset: time.Hour, want: "x offset 1h / y offset 1h"},
+		{name: "subquery", formula: "max_over_time(rate(x[5m])[1h:])", offset: week, want: "max_over_time(rate(x[5m])[1h:] offset 1w)"},
+		{name: "offset expression", formula: "x offset (1h)", offset: week, wantErr: true},
+		{name: "unparseable", formula: "x >", offset: week, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := OffsetFormula(tt.formula, tt.offset)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("OffsetFormula(%q) error = %v, wantErr %v", tt.formula, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("OffsetFormula(%q) = %q, want %q", tt.formula, got, tt.want)
+			}
+		})
+	}
+}
+
+// Past values as Prometheus returns them for an offset query, stamped with
+// the evaluation times of the range.
+const comparisonResponse = `{
+  "status": "success",
+  "data": {
+    "resultType": "matrix",
+    "result": [
+      {"metric": {"instance": "a"}, "values": [[1709294400, "1"], [1709294460, "2"]]},
+      {"metric": {"instance": "b"}, "values": [[1709294400, "3"], [1709294460, "4"]]},
+      {"metric": {"instance": "c"}, "values": [[1709294400, "5"], [1709294460, "6"]]}
+    ]
+  }
+}`
+
+func TestComparisonMetrics(t *testing.T) {
+	viper.Set("query_timeout", time.Second)
+	viper.Set("query_retries", 0)
+	var query string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		query = r.Form.Get("query")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(comparisonResponse))
+	}))
+	defer srv.Close()
+	datasource := Datasource{Name: "comparison", URL: srv.URL}
+	queryTime := time.Unix(1709294460, 0)
+
+	instance := func(name string) *model.SampleStream {
+		return &model.SampleStream{Metric: model.Metric{"instance": model.LabelValue(name)}}
+	}
+	aggregate := func(name string) *model.SampleStream {
+		return &model.SampleStream{Metric: model.Metric{"series": model.LabelValue(name)}}
+	}
+
+	tests := []struct {
+		name    string
+		plotted model.Matrix
+		want    map[string][]model.SampleValue
+	}{
+		{
+			name:    "plotted series",
+			plotted: model.Matrix{instance("a"), instance("c"), instance("d")},
+			want:    map[string][]model.SampleValue{`{instance="a"}`: {1, 2}, `{instance="c"}`: {5, 6}},
+		},
+		{
+			name:    "top with other",
+			plotted: model.Matrix{instance("a"), aggregate("other")},
+			want:    map[string][]model.SampleValue{`{instance="a"}`: {1, 2}, `{series="other"}`: {8, 10}},
+		},
+		{
+			name:    "envelope",
+			plotted: model.Matrix{aggregate("max"), aggregate("median"), aggregate("min")},
+			want: map[string][]model.SampleValue{
+				`{series="max"}`:    {5, 6},
+				`{series="median"}`: {3, 4},
+				`{series="min"}`:    {1, 2},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expr := PlotExpr{Formula: "rate(x[5m])", Operator: ">", Level: 1}
+			got, err := ComparisonMetrics(context.Background(), expr, 24*time.Hour, tt.plotted, queryTime, time.Minute, time.Minute, datasource)
+			if err != nil {
+				t.Fatalf("ComparisonMetrics() error = %v", err)
+			}
+			if !strings.Contains(query, "offset 1d") {
+				t.Errorf("ComparisonMetrics() queried %q, want an offset of 1d", query)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("ComparisonMetrics() = %v, want %v", got, tt.want)
+			}
+			for _, sample := range got {
+				want, ok := tt.want[sample.Metric.String()]
+				if !ok || len(sample.Values) != len(want) {
+					t.Fatalf("ComparisonMetrics() series %s = %v, want %v", sample.Metric, sample.Values, want)
+				}
+				for i, v := range sample.Values {
+					// at the evaluation times of the plotted range, not shifted
+					wantTime := model.TimeFromUnix(1709294400 + int64(i)*60)
+					if v.Timestamp != wantTime || v.Value != want[i] {
+						t.Errorf("ComparisonMetrics() series %s[%d] = %v @%v, want %v @%v", sample.Metric, i, v.Value, v.Timestamp, want[i], wantTime)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/bugsnag/bugsnag-go/v2"
+	"github.com/bugsnag/microkit/clog"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Datasource is a Prometheus server to query and how to reach it.
+type Datasource struct {
+	Name string
+	URL  string
+	HTTP HTTPClientConfig
+	// Tenant is the tenant queried as on multi-tenant servers
+	Tenant string
+	Query  QueryParams
+	// GrafanaUID is the Grafana datasource of the server, for links
+	GrafanaUID string
+}
+
+// DatasourceConfig is an entry of the `datasources` config. Alerts are
+// matched to it by the host of their generator URL, or by Labels such as
+// the external labels of the server.
+type DatasourceConfig struct {
+	Name        string           `mapstructure:"name"`
+	URL         string           `mapstructure:"url"`
+	HTTPConfig  HTTPClientConfig `mapstructure:"http_config"`
+	QueryParams QueryParams      `mapstructure:"query_params"`
+	GrafanaUID  string           `mapstructure:"grafana_uid"`
+	// GeneratorHosts are the hosts in generator URLs of alerts from the
+	// server, when they differ from the host of URL
+	GeneratorHosts []string          `mapstructure:"generator_hosts"`
+	Labels         map[string]string `mapstructure:"labels"`
+}
+
+func (cfg DatasourceConfig) datasource(alert Alert) Datasource {
+	return Datasource{
+		Name:       cfg.Name,
+		URL:        cfg.URL,
+		HTTP:       cfg.HTTPConfig,
+		Tenant:     cfg.HTTPConfig.TenantFor(alert.Labels),
+		Query:      cfg.QueryParams,
+		GrafanaUID: cfg.GrafanaUID,
+	}
+}
+
+func (cfg DatasourceConfig) matchesHost(host string) bool {
+	for _, generatorHost := range cfg.GeneratorHosts {
+		if strings.EqualFold(generatorHost, host) {
+			return true
+		}
+	}
+
+	serverURL, err := url.Parse(cfg.URL)
+	return err == nil && strings.EqualFold(serverURL.Host, host)
+}
+
+func (cfg DatasourceConfig) matchesLabels(labels KV) bool {
+	if len(cfg.Labels) == 0 {
+		return false
+	}
+	for name, value := range cfg.Labels {
+		if labels[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// ResolveDatasource returns the Prometheus server to query for the alert.
+// It is the datasource the generator URL of the alert names or points at,
+// else the first one whose labels the alert carries, else the datasource
+// set in the route of the receiver. Alerts matching none are queried from
+// `prometheus_url` with `prometheus_http_config`, `prometheus_query_params`
+// and `grafana_datasource_uid`. Query params of the link, such as Thanos
+// deduplication, apply where the datasource doesn't set them.
+func (alert Alert) ResolveDatasource(link GeneratorLink) Datasource {
+	datasource := alert.resolveDatasource(link)
+	datasource.Query = datasource.Query.withDefaults(link.Query)
+	return datasource
+}
+
+func (alert Alert) resolveDatasource(link GeneratorLink) Datasource {
+	var datasources []DatasourceConfig
+	if err := viper.UnmarshalKey("datasources", &datasources); err != nil {
+		err = errors.Wrap(err, "Could not parse datasources config")
+		_ = bugsnag.Notify(err)
+		clog.Error(err.Error())
+	}
+
+	if link.Datasource != "" {
+		for _, cfg := range datasources {
+			if cfg.Name == link.Datasource || (cfg.GrafanaUID != "" && cfg.GrafanaUID == link.Datasource) {
+				clog.Infof("Datasource %s named by generator URL", cfg.Name)
+				return cfg.datasource(alert)
+			}
+		}
+	}
+
+	if generatorURL, err := url.Parse(alert.GeneratorURL); err == nil && generatorURL.Host != "" {
+		for _, cfg := range datasources {
+			if cfg.matchesHost(generatorURL.Host) {
+				clog.Infof("Datasource %s matched by generator URL host %s", cfg.Name, generatorURL.Host)
+				return cfg.datasource(alert)
+			}
+		}
+	}
+
+	for _, cfg := range datasources {
+		if cfg.matchesLabels(alert.Labels) {
+			clog.Infof("Datasource %s matched by labels %v", cfg.Name, cfg.Labels)
+			return cfg.datasource(alert)
+		}
+	}
+
+	if name := GetRouteConfig(alert.Receiver).Datasource; name != "" {
+		for _, cfg := range datasources {
+			if cfg.Name == name {
+				clog.Infof("Datasource %s set for receiver %s", cfg.Name, alert.Receiver)
+				return cfg.datasource(alert)
+			}
+		}
+		clog.Warnf("Unknown datasource %s set for receiver %s", name, alert.Receiver)
+	}
+
+	var httpConfig HTTPClientConfig
+	if err := viper.UnmarshalKey("prometheus_http_config", &httpConfig); err != nil {
+		err = errors.Wrap(err, "Could not parse Prometheus HTTP config")
+		_ = bugsnag.Notify(err)
+		clog.Error(err.Error())
+	}
+
+	var queryParams QueryParams
+	if err := viper.UnmarshalKey("prometheus_query_params", &queryParams); err != nil {
+		err = errors.Wrap(err, "Could not parse Prometheus query params")
+		_ = bugsnag.Notify(err)
+		clog.Error(err.Error())
+	}
+
+	return Datasource{
+		Name:       "default",
+		URL:        viper.GetString("prometheus_url"),
+		HTTP:       httpConfig,
+		Tenant:     httpConfig.TenantFor(alert.Labels),
+		Query:      queryParams,
+		GrafanaUID: viper.GetString("grafana_datasource_uid"),
+	}
+}
+
+// QueryParams are URL parameters added to the queries of a datasource, for
+// Thanos Query or long-term stores behind a query frontend.
+type QueryParams struct {
+	Dedup           *bool `mapstructure:"dedup"`
+	PartialResponse *bool `mapstructure:"partial_response"`
+	// MaxSourceResolution picks downsampled data, e.g. 5m, 1h or auto
+	MaxSourceResolution string            `mapstructure:"max_source_resolution"`
+	Params              map[string]string `mapstructure:"params"`
+}
+
+func (params QueryParams) values() url.Values {
+	values := url.Values{}
+	for name, value := range params.Params {
+		values.Set(name, value)
+	}
+	if params.Dedup != nil {
+		values.Set("dedup", strconv.FormatBool(*params.Dedup))
+	}
+	if params.PartialResponse != nil {
+		values.Set("partial_response", strconv.FormatBool(*params.PartialResponse))
+	}
+	if params.MaxSourceResolution != "" {
+		values.Set("max_source_resolution", params.MaxSourceResolution)
+	}
+	return values
+}
+
+// withDefaults fills the params that aren't set from defaults.
+func (params QueryParams) withDefaults(defaults QueryParams) QueryParams {
+	if params.Dedup == nil {
+		params.Dedup = defaults.Dedup
+	}
+	if params.PartialResponse == nil {
+		params.PartialResponse = defaults.PartialResponse
+	}
+	if params.MaxSourceResolution == "" {
+		params.MaxSourceResolution = defaults.MaxSourceResolution
+	}
+	return params
+}
+
+// RoundTripper adds the params to the URL of requests, which servers read
+// along with the form of POST requests.
+func (params QueryParams) RoundTripper(next http.RoundTripper) http.RoundTripper {
+	values := params.values()
+	if len(values) == 0 {
+		return next
+	}
+	return &queryParamsRoundTripper{values: values, next: next}
+}
+
+type queryParamsRoundTripper struct {
+	values url.Values
+	next   http.RoundTripper
+}
+
+func (rt *queryParamsRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	query := req.URL.Query()
+	for name, values := range rt.values {
+		if _, ok := query[name]; !ok {
+			query[name] = values
+		}
+	}
+	req.URL.RawQuery = query.Encode()
+	return rt.next.RoundTrip(req)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestResolveDatasource(t *testing.T) {
+	viper.Set("prometheus_url", "http://prometheus:9090")
+	viper.Set("grafana_datasource_uid", "default-uid")
+	viper.Set("datasources", []map[string]interface{}{
+		{"name": "a", "url": "http://prom-a:9090", "grafana_uid": "uid-a"},
+		{"name": "b", "url": "http://prom-b:9090", "labels": map[string]string{"cluster": "eu"}},
+		{"name": "c", "url": "http://thanos:10902", "grafana_uid": "uid-c", "generator_hosts": []string{"ruler.example.com"}},
+	})
+	viper.Set("routes", map[string]interface{}{
+		"team-c":  map[string]interface{}{"datasource": "c"},
+		"team-x":  map[string]interface{}{"datasource": "x"},
+		"default": map[string]interface{}{},
+	})
+	defer func() {
+		viper.Set("datasources", nil)
+		viper.Set("routes", nil)
+	}()
+
+	tests := []struct {
+		name     string
+		alert    Alert
+		link     GeneratorLink
+		wantName string
+	}{
+		{
+			name:     "named by link",
+			link:     GeneratorLink{Datasource: "b"},
+			wantName: "b",
+		},
+		{
+			name:     "Grafana UID of link",
+			link:     GeneratorLink{Datasource: "uid-c"},
+			wantName: "c",
+		},
+		{
+			name:     "link before generator host",
+			alert:    Alert{GeneratorURL: "http://prom-a:9090/graph"},
+			link:     GeneratorLink{Datasource: "uid-c"},
+			wantName: "c",
+		},
+		{
+			name:     "unknown link datasource",
+			alert:    Alert{GeneratorURL: "http://prom-a:9090/graph"},
+			link:     GeneratorLink{Datasource: "other"},
+			wantName: "a",
+		},
+		{
+			name:     "generator host",
+			alert:    Alert{GeneratorURL: "http://PROM-A:9090/graph?g0.expr=up"},
+			wantName: "a",
+		},
+		{
+			name:     "generator hosts",
+			alert:    Alert{GeneratorURL: "https://ruler.example.com/graph"},
+			wantName: "c",
+		},
+		{
+			name:     "generator host before labels",
+			alert:    Alert{GeneratorURL: "http://prom-a:9090/graph", Labels: KV{"cluster": "eu"}},
+			wantName: "a",
+		},
+		{
+			name:     "labels",
+			alert:    Alert{GeneratorURL: "http://elsewhere/graph", Labels: KV{"cluster": "eu", "job": "api"}},
+			wantName: "b",
+		},
+		{
+			name:     "labels before route",
+			alert:    Alert{Receiver: "team-c", Labels: KV{"cluster": "eu"}},
+			wantName: "b",
+		},
+		{
+			name:     "route",
+			alert:    Alert{Receiver: "Team-C", Labels: KV{"cluster": "us"}},
+			wantName: "c",
+		},
+		{
+			name:     "unknown route datasource",
+			alert:    Alert{Receiver: "team-x"},
+			wantName: "default",
+		},
+		{
+			name:     "default",
+			alert:    Alert{Receiver: "default", GeneratorURL: "http://elsewhere/graph"},
+			wantName: "default",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.alert.ResolveDatasource(tt.link); got.Name != tt.wantName {
+				t.Errorf("ResolveDatasource() = %s, want %s", got.Name, tt.wantName)
+			}
+		})
+	}
+
+	t.Run("default settings", func(t *testing.T) {
+		got := Alert{}.ResolveDatasource(GeneratorLink{})
+		if got.URL != "http://prometheus:9090" || got.GrafanaUID != "default-uid" {
+			t.Errorf("ResolveDatasource() = %s, %s, want http://prometheus:9090, default-uid", got.URL, got.GrafanaUID)
+		}
+	})
+
+	t.Run("datasource settings", func(t *testing.T) {
+		got := Alert{}.ResolveDatasource(GeneratorLink{Datasource: "a"})
+		if got.URL != "http://prom-a:9090" || got.GrafanaUID != "uid-a" {
+			t.Errorf("ResolveDatasource() = %s, %s, want http://prom-a:9090, uid-a", got.URL, got.GrafanaUID)
+		}
+	})
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bugsnag/microkit/clog"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+)
+
+// GeneratorLink is what the generator URL of an alert tells about it.
+type GeneratorLink struct {
+	Panels []GeneratorPanel
+	// Datasource names the datasource of the linked UI, such as the UID or
+	// name of a Grafana datasource
+	Datasource string
+	// Query holds the params the linked UI queries with, such as Thanos
+	// deduplication
+	Query QueryParams
+}
+
+// ParseGeneratorURL reads the panels of the UI an alert links to: the
+// Prometheus and Thanos Query UIs, Grafana Explore and VMUI.
+func ParseGeneratorURL(generatorURL string) (GeneratorLink, error) {
+	var link GeneratorLink
+	u, err := url.Parse(generatorURL)
+	if err != nil {
+		return link, errors.Wrap(err, "failed to parse generator URL")
+	}
+	query := u.Query()
+
+	switch {
+	case query.Get("panes") != "" || query.Get("left") != "":
+		return parseExploreLink(query)
+	case strings.Contains(u.Fragment, "?"):
+		// VMUI keeps its state in the fragment, e.g. vmui/#/?g0.expr=up
+		query, err = url.ParseQuery(u.Fragment[strings.Index(u.Fragment, "?")+1:])
+		if err != nil {
+			return link, errors.Wrap(err, "failed to parse generator URL fragment")
+		}
+	}
+
+	link.Panels = ParseGeneratorPanels(query)
+	link.Query = thanosQueryParams(query)
+	return link, nil
+}
+
+// GeneratorPanel is a graph linked from the generator URL of an alert.
+type GeneratorPanel struct {
+	Expr string
+	// Range is the graphed time range, zero when the link doesn't set one
+	Range time.Duration
+	// End is the end of the range, zero for now
+	End time.Time
+}
+
+// Prometheus UI panel params such as g0.expr or g1.range_input
+var panelParam = regexp.MustCompile(`^g(\d+)\.(\w+)$`)
+
+// Prometheus UI and VMUI dates, in UTC
+var panelTimeFormats = []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", time.RFC3339}
+
+// ParseGeneratorPanels returns the panels of a Prometheus UI link, ordered
+// by their index. The tab of a panel is ignored, Prometheus links alerts to
+// the table tab but graphs tell more in a message.
+func ParseGeneratorPanels(generatorQuery url.Values) []GeneratorPanel {
+	panels := make(map[int]*GeneratorPanel)
+	for key, values := range generatorQuery {
+		m := panelParam.FindStringSubmatch(key)
+		if m == nil || len(values) == 0 || values[0] == "" {
+			continue
+		}
+		index, err := strconv.Atoi(m[1])
+		if err != nil {
+			continue
+		}
+		if panels[index] == nil {
+			panels[index] = &GeneratorPanel{}
+		}
+		panel, value := panels[index], values[0]
+
+		switch m[2] {
+		case "expr":
+			panel.Expr = value
+		case "range_input":
+			if r, err := model.ParseDuration(value); err == nil {
+				panel.Range = time.Duration(r)
+			} else {
+				clog.Warnf("Ignoring range of panel %d: %s", index, value)
+			}
+		case "end", "end_input", "moment_input":
+			if end, ok := parsePanelTime(value); ok {
+				panel.End = end
+			} else {
+				clog.Warnf("Ignoring end of panel %d: %s", index, value)
+			}
+		}
+	}
+
+	indexes := make([]int, 0, len(panels))
+	for index, panel := range panels {
+		if strings.TrimSpace(panel.Expr) != "" {
+			indexes = append(indexes, index)
+		}
+	}
+	sort.Ints(indexes)
+
+	result := make([]GeneratorPanel, 0, len(indexes))
+	for _, index := range indexes {
+		result = append(result, *panels[index])
+	}
+	return result
+}
+
+// parsePanelTime reads the end of a panel, as a UI date or a Unix
+// timestamp.
+func parsePanelTime(value string) (time.Time, bool) {
+	for _, layout := range panelTimeFormats {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Unix(0, int64(seconds*float64(time.Second))), true
+	}
+	return time.Time{}, false
+}
+
+// thanosQueryParams returns the query params of the first panel of a Thanos
+// Query UI link.
+func thanosQueryParams(query url.Values) QueryParams {
+	var params QueryParams
+	if dedup, err := strconv.ParseBool(query.Get("g0.deduplicate")); err == nil {
+		params.Dedup = &dedup
+	}
+	if partialResponse, err := strconv.ParseBool(query.Get("g0.partial_response")); err == nil {
+		params.PartialResponse = &partialResponse
+	}
+	params.MaxSourceResolution = query.Get("g0.max_source_resolution")
+	return params
+}
+
+// exploreState is a pane of Grafana Explore, as in the panes param or the
+// left param of older versions. Datasources are either a name or UID, or
+// a reference holding the UID.
+type exploreState struct {
+	Datasource json.RawMessage     `json:"datasource"`
+	Queries    []exploreStateQuery `json:"queries"`
+	Range      exploreRange        `json:"range"`
+}
+
+type exploreStateQuery struct {
+	Expr       string          `json:"expr"`
+	Datasource json.RawMessage `json:"datasource"`
+}
+
+func parseExploreLink(query url.Values) (GeneratorLink, error) {
+	var link GeneratorLink
+	var panes []exploreState
+
+	if query.Get("panes") != "" {
+		var byID map[string]exploreState
+		if err := json.Unmarshal([]byte(query.Get("panes")), &byID); err != nil {
+			return link, errors.Wrap(err, "failed to parse Explore panes")
+		}
+		ids := make([]string, 0, len(byID))
+		for id := range byID {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			panes = append(panes, byID[id])
+		}
+	} else {
+		pane, err := parseExploreLeft(query.Get("left"))
+		if err != nil {
+			return link, err
+		}
+		panes = append(panes, pane)
+	}
+
+	now := time.Now()
+	for _, pane := range panes {
+		var panel GeneratorPanel
+		from, fromOK := parseExploreTime(pane.Range.From, now)
+		to, toOK := parseExploreTime(pane.Range.To, now)
+		if fromOK && toOK && from.Before(to) {
+			panel.Range = to.Sub(from)
+			if pane.Range.To != "now" {
+				panel.End = to
+			}
+		}
+
+		for _, q := range pane.Queries {
+			if strings.TrimSpace(q.Expr) == "" {
+				continue
+			}
+			panel.Expr = q.Expr
+			link.Panels = append(link.Panels, panel)
+			if link.Datasource == "" {
+				link.Datasource = exploreDatasourceRef(q.Datasource)
+			}
+		}
+		if link.Datasource == "" {
+			link.Datasource = exploreDatasourceRef(pane.Datasource)
+		}
+	}
+
+	return link, nil
+}
+
+// parseExploreLeft reads the left param, an exploreState or in the legacy
+// compact format an array of from, to, datasource and then the queries.
+func parseExploreLeft(left string) (exploreState, error) {
+	var pane exploreState
+	if strings.HasPrefix(strings.TrimSpace(left), "[") {
+		var compact []json.RawMessage
+		if err := json.Unmarshal([]byte(left), &compact); err != nil {
+			return pane, errors.Wrap(err, "failed to parse Explore state")
+		}
+		if len(compact) < 3 {
+			return pane, errors.Errorf("Explore state too short: %s", left)
+		}
+		_ = json.Unmarshal(compact[0], &pane.Range.From)
+		_ = json.Unmarshal(compact[1], &pane.Range.To)
+		pane.Datasource = compact[2]
+		for _, raw := range compact[3:] {
+			var q exploreStateQuery
+			if err := json.Unmarshal(raw, &q); err == nil && q.Expr != "" {
+				pane.Queries = append(pane.Queries, q)
+			}
+		}
+		return pane, nil
+	}
+
+	if err := json.Unmarshal([]byte(left), &pane); err != nil {
+		return pane, errors.Wrap(err, "failed to parse Explore state")
+	}
+	return pane, nil
+}
+
+// exploreDatasourceRef returns the datasource name or UID of a reference.
+func exploreDatasourceRef(raw json.RawMessage) string {
+	var name string
+	if err := json.Unmarshal(raw, &name); err == nil {
+		return name
+	}
+	var ref exploreDatasource
+	if err := json.Unmarshal(raw, &ref); err == nil {
+		return ref.UID
+	}
+	return ""
+}
+
+// parseExploreTime reads a time of an Explore range: now, now minus a
+// duration such as now-1h, or Unix milliseconds.
+func parseExploreTime(value string, now time.Time) (time.Time, bool) {
+	if value == "now" {
+		return now, true
+	}
+	if strings.HasPrefix(value, "now-") {
+		d, err := model.ParseDuration(strings.TrimPrefix(value, "now-"))
+		if err != nil {
+			return time.Time{}, false
+		}
+		return now.Add(-time.Duration(d)), true
+	}
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.UnixMilli(ms), true
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
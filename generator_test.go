@@ -0,0 +1,195 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseGeneratorPanels(t *testing.T) {
+	end := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		query url.Values
+		want  []GeneratorPanel
+	}{
+		{
+			name:  "single panel",
+			query: url.Values{"g0.expr": {"up == 0"}, "g0.tab": {"1"}},
+			want:  []GeneratorPanel{{Expr: "up == 0"}},
+		},
+		{
+			name: "ordered by index",
+			query: url.Values{
+				"g10.expr":       {"z > 1"},
+				"g1.expr":        {"rate(x[5m]) > 1"},
+				"g1.range_input": {"6h"},
+				"g1.end_input":   {"2024-03-01 12:00:00"},
+				"g0.expr":        {"up == 0"},
+				"g0.range_input": {"1h"},
+			},
+			want: []GeneratorPanel{
+				{Expr: "up == 0", Range: time.Hour},
+				{Expr: "rate(x[5m]) > 1", Range: 6 * time.Hour, End: end},
+				{Expr: "z > 1"},
+			},
+		},
+		{
+			name:  "RFC 3339 end",
+			query: url.Values{"g0.expr": {"up == 0"}, "g0.end_input": {"2024-03-01T12:00:00Z"}},
+			want:  []GeneratorPanel{{Expr: "up == 0", End: end}},
+		},
+		{
+			name:  "Unix end",
+			query: url.Values{"g0.expr": {"up == 0"}, "g0.moment_input": {"1709294400"}},
+			want:  []GeneratorPanel{{Expr: "up == 0", End: end}},
+		},
+		{
+			name:  "unusable range and end",
+			query: url.Values{"g0.expr": {"up == 0"}, "g0.range_input": {"an hour"}, "g0.end_input": {"yesterday"}},
+			want:  []GeneratorPanel{{Expr: "up == 0"}},
+		},
+		{
+			name:  "panels without an expression",
+			query: url.Values{"g0.expr": {""}, "g1.range_input": {"1h"}, "g2.expr": {" "}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ParseGeneratorPanels(tt.query)
+			if len(got) != len(tt.want) {
+				t.Fatalf("ParseGeneratorPanels() = %v, want %v", got, tt.want)
+			}
+			for i, panel := range got {
+				want := tt.want[i]
+				if panel.Expr != want.Expr || panel.Range != want.Range || !panel.End.Equal(want.End) {
+					t.Errorf("ParseGeneratorPanels()[%d] = %v, want %v", i, panel, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseGeneratorURL(t *testing.T) {
+	end := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	from, to := end.Add(-2*time.Hour).UnixMilli(), end.UnixMilli()
+	yes, no := true, false
+
+	tests := []struct {
+		name           string
+		url            string
+		wantPanels     []GeneratorPanel
+		wantDatasource string
+		wantQuery      QueryParams
+		wantErr        bool
+	}{
+		{
+			name:       "Prometheus",
+			url:        "http://prometheus/graph?g0.expr=up+%3D%3D+0&g0.tab=1",
+			wantPanels: []GeneratorPanel{{Expr: "up == 0"}},
+		},
+		{
+			name: "Thanos",
+			url: "http://thanos/graph?" + url.Values{
+				"g0.expr":                  {"up == 0"},
+				"g0.deduplicate":           {"0"},
+				"g0.partial_response":      {"1"},
+				"g0.max_source_resolution": {"5m"},
+			}.Encode(),
+			wantPanels: []GeneratorPanel{{Expr: "up == 0"}},
+			wantQuery:  QueryParams{Dedup: &no, PartialResponse: &yes, MaxSourceResolution: "5m"},
+		},
+		{
+			name: "Explore panes",
+			url: "http://grafana/explore?" + url.Values{
+				"panes": {`{"b":{"datasource":"prom","queries":[{"expr":"y > 1"}],"range":{"from":"now-1h","to":"now"}},` +
+					`"a":{"datasource":"prom","queries":[{"refId":"A","expr":"x > 1","datasource":{"type":"prometheus","uid":"P1"}}],` +
+					`"range":{"from":"` + strconv.FormatInt(from, 10) + `","to":"` + strconv.FormatInt(to, 10) + `"}}}`},
+			}.Encode(),
+			wantPanels: []GeneratorPanel{
+				{Expr: "x > 1", Range: 2 * time.Hour, End: end},
+				{Expr: "y > 1", Range: time.Hour},
+			},
+			wantDatasource: "P1",
+		},
+		{
+			name: "Explore left",
+			url: "http://grafana/explore?" + url.Values{
+				"left": {`{"datasource":{"type":"prometheus","uid":"P2"},"queries":[{"expr":"x > 1"},{"expr":" "}],"range":{"from":"now-6h","to":"now"}}`},
+			}.Encode(),
+			wantPanels:     []GeneratorPanel{{Expr: "x > 1", Range: 6 * time.Hour}},
+			wantDatasource: "P2",
+		},
+		{
+			name: "Explore compact left",
+			url: "http://grafana/explore?" + url.Values{
+				"left": {`["now-1h","now","Prometheus",{"expr":"x > 1"},{"ui":[true,true,true,"none"]}]`},
+			}.Encode(),
+			wantPanels:     []GeneratorPanel{{Expr: "x > 1", Range: time.Hour}},
+			wantDatasource: "Prometheus",
+		},
+		{
+			name:    "Explore compact left too short",
+			url:     "http://grafana/explore?" + url.Values{"left": {`["now-1h","now"]`}}.Encode(),
+			wantErr: true,
+		},
+		{
+			name:    "Explore panes unparseable",
+			url:     "http://grafana/explore?" + url.Values{"panes": {`{"a":`}}.Encode(),
+			wantErr: true,
+		},
+		{
+			name:       "VMUI",
+			url:        "http://victoriametrics/vmui/#/?g0.expr=up+%3D%3D+0&g0.range_input=30m&g0.end_input=2024-03-01T12%3A00%3A00",
+			wantPanels: []GeneratorPanel{{Expr: "up == 0", Range: 30 * time.Minute, End: end}},
+		},
+		{
+			name: "no panels",
+			url:  "http://alertmanager/",
+		},
+		{
+			name:    "unparseable",
+			url:     "http://prometheus/%zz",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseGeneratorURL(tt.url)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseGeneratorURL() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(got.Panels) != len(tt.wantPanels) {
+				t.Fatalf("ParseGeneratorURL().Panels = %v, want %v", got.Panels, tt.wantPanels)
+			}
+			for i, panel := range got.Panels {
+				want := tt.wantPanels[i]
+				if panel.Expr != want.Expr || panel.Range != want.Range || !panel.End.Equal(want.End) {
+					t.Errorf("ParseGeneratorURL().Panels[%d] = %v, want %v", i, panel, want)
+				}
+			}
+			if got.Datasource != tt.wantDatasource {
+				t.Errorf("ParseGeneratorURL().Datasource = %q, want %q", got.Datasource, tt.wantDatasource)
+			}
+			if !equalBool(got.Query.Dedup, tt.wantQuery.Dedup) ||
+				!equalBool(got.Query.PartialResponse, tt.wantQuery.PartialResponse) ||
+				got.Query.MaxSourceResolution != tt.wantQuery.MaxSourceResolution {
+				t.Errorf("ParseGeneratorURL().Query = %+v, want %+v", got.Query, tt.wantQuery)
+			}
+		})
+	}
+}
+
+func equalBool(a, b *bool) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bugsnag/microkit/clog"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+type GrafanaClient struct {
+	HTTPClient *http.Client
+	ApiKey     string
+	BaseURL    string
+	UserAgent  string
+}
+
+// GrafanaPanel identifies a dashboard panel to render.
+type GrafanaPanel struct {
+	DashboardUID string
+	PanelID      string
+}
+
+func NewGrafanaClient() *GrafanaClient {
+	var cli GrafanaClient
+	cli.ApiKey = viper.GetString("grafana_api_key")
+	cli.BaseURL = viper.GetString("grafana_url")
+	cli.UserAgent = "promalert/v1 (+https://github.com/bugsnag/promalert)"
+	cli.HTTPClient = &http.Client{
+		// rendering starts a headless browser and can be slow
+		Timeout: viper.GetDuration("grafana_render_timeout"),
+	}
+	return &cli
+}
+
+func (cli *GrafanaClient) error(statusCode int, body io.Reader) error {
+	buf, err := io.ReadAll(body)
+	if err != nil || len(buf) == 0 {
+		return errors.Errorf("request failed with status code %d", statusCode)
+	}
+	return errors.Errorf("status code: %d, error: %s", statusCode, string(buf))
+}
+
+func (cli *GrafanaClient) do(req *http.Request) (*http.Response, error) {
+	if cli.ApiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+cli.ApiKey)
+	}
+	req.Header.Set("User-Agent", cli.UserAgent)
+	return cli.HTTPClient.Do(req)
+}
+
+// RenderPanel renders a dashboard panel as a PNG image over a time range,
+// using the Grafana image renderer.
+func (cli *GrafanaClient) RenderPanel(ctx context.Context, panel GrafanaPanel, queryTime time.Time, duration time.Duration) (*bytes.Buffer, error) {
+	params := url.Values{}
+	params.Set("panelId", panel.PanelID)
+	params.Set("from", strconv.FormatInt(queryTime.Add(-duration).UnixMilli(), 10))
+	params.Set("to", strconv.FormatInt(queryTime.UnixMilli(), 10))
+	params.Set("width", viper.GetString("grafana_render_width"))
+	params.Set("height", viper.GetString("grafana_render_height"))
+	params.Set("tz", "UTC")
+	if orgID := viper.GetString("grafana_org_id"); orgID != "" {
+		params.Set("orgId", orgID)
+	}
+	reqURL := fmt.Sprintf("%s/render/d-solo/%s/?%s", cli.BaseURL, url.PathEscape(panel.DashboardUID), params.Encode())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Create HTTP request: %w", err)
+	}
+
+	resp, err := cli.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Do HTTP request: %w", err)
+	}
+
+	defer func() {
+		if cerr := resp.Body.Close(); cerr != nil {
+			clog.Warnf("closing response body: %v", cerr)
+		}
+	}()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return nil, fmt.Errorf("http response: %w", cli.error(resp.StatusCode, resp.Body))
+	}
+	// Grafana answers errors of the renderer with a page rather than a status
+	if contentType := resp.Header.Get("Content-Type"); contentType != "image/png" {
+		return nil, errors.Errorf("unexpected content type %s", contentType)
+	}
+
+	var image bytes.Buffer
+	if _, err := image.ReadFrom(resp.Body); err != nil {
+		return nil, fmt.Errorf("read http body: %w", err)
+	}
+
+	return &image, nil
+}
+
+// GrafanaPanel returns the dashboard panel set on the alert rule with the
+// grafana_dashboard_uid and grafana_panel_id annotations.
+func (alert Alert) GrafanaPanel() (GrafanaPanel, bool) {
+	panel := GrafanaPanel{
+		DashboardUID: alert.Annotations["grafana_dashboard_uid"],
+		PanelID:      alert.Annotations["grafana_panel_id"],
+	}
+	return panel, panel.DashboardUID != "" && panel.PanelID != ""
+}
+
+type explorePane struct {
+	Datasource string         `json:"datasource,omitempty"`
+	Queries    []exploreQuery `json:"queries"`
+	Range      exploreRange   `json:"range"`
+}
+
+type exploreQuery struct {
+	RefID      string             `json:"refId"`
+	Expr       string             `json:"expr"`
+	Datasource *exploreDatasource `json:"datasource,omitempty"`
+}
+
+type exploreDatasource struct {
+	Type string `json:"type"`
+	UID  string `json:"uid"`
+}
+
+type exploreRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// GrafanaLinks links to the alert expression in Grafana Explore and to the
+// dashboard panel of the alert, over the graphed time range.
+func (alert Alert) GrafanaLinks(formula string, datasource Datasource, queryTime time.Time, duration time.Duration) AlertLinks {
+	var links AlertLinks
+	baseURL := strings.TrimSuffix(viper.GetString("grafana_url"), "/")
+	if baseURL == "" {
+		return links
+	}
+
+	from := strconv.FormatInt(queryTime.Add(-duration).UnixMilli(), 10)
+	to := strconv.FormatInt(queryTime.UnixMilli(), 10)
+	orgID := viper.GetString("grafana_org_id")
+
+	if formula != "" {
+		query := exploreQuery{RefID: "A", Expr: formula}
+		pane := explorePane{Queries: []exploreQuery{query}, Range: exploreRange{From: from, To: to}}
+		if uid := datasource.GrafanaUID; uid != "" {
+			pane.Datasource = uid
+			pane.Queries[0].Datasource = &exploreDatasource{Type: "prometheus", UID: uid}
+		}
+
+		panes, err := json.Marshal(map[string]explorePane{"a": pane})
+		if err != nil {
+			clog.Warnf("Failed to build Explore link: %s", err.Error())
+		} else {
+			params := url.Values{}
+			params.Set("schemaVersion", "1")
+			params.Set("panes", string(panes))
+			if orgID != "" {
+				params.Set("orgId", orgID)
+			}
+			links.Explore = baseURL + "/explore?" + params.Encode()
+		}
+	}
+
+	if uid := alert.Annotations["grafana_dashboard_uid"]; uid != "" {
+		params := url.Values{}
+		params.Set("from", from)
+		params.Set("to", to)
+		if panelID := alert.Annotations["grafana_panel_id"]; panelID != "" {
+			params.Set("viewPanel", panelID)
+		}
+		if orgID != "" {
+			params.Set("orgId", orgID)
+		}
+		links.Dashboard = fmt.Sprintf("%s/d/%s?%s", baseURL, url.PathEscape(uid), params.Encode())
+	}
+
+	return links
+}
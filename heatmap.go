@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"image/color"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bugsnag/microkit/clog"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/spf13/viper"
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/palette/brewer"
+	"gonum.org/v1/plot/vg"
+	"gonum.org/v1/plot/vg/draw"
+)
+
+// HistogramBucketsFormula returns the query for the bucket distribution
+// behind a histogram_quantile formula, summed into a single histogram.
+// Classic histograms are summed by le, native ones into one histogram.
+func HistogramBucketsFormula(formula string, alertLabels KV) (string, bool) {
+	expr, err := parser.ParseExpr(formula)
+	if err != nil {
+		return "", false
+	}
+
+	call, ok := unwrapParens(expr).(*parser.Call)
+	if !ok || call.Func.Name != "histogram_quantile" || len(call.Args) != 2 {
+		return "", false
+	}
+
+	inner := call.Args[1].String()
+	if viper.GetBool("label_pushdown") {
+		if injected, ok, err := InjectLabels(inner, alertLabels); err == nil && ok {
+			inner = injected
+		}
+	}
+
+	if selector := firstSelector(call.Args[1]); selector != nil && strings.HasSuffix(selectorName(selector), "_bucket") {
+		return "sum by (le) (" + inner + ")", true
+	}
+	return "sum(" + inner + ")", true
+}
+
+// histogramHeatmap fetches the buckets behind a histogram_quantile formula
+// over the graphed range. The graph is still useful without them, so
+// failures are logged and nil is returned.
+func histogramHeatmap(ctx context.Context, expr PlotExpr, queryTime time.Time, duration, step time.Duration, datasource Datasource, alert Alert) *bucketHeatmap {
+	formula, ok := HistogramBucketsFormula(expr.Formula, alert.Labels)
+	if !ok {
+		clog.Infof("Not a histogram quantile, drawing without heatmap: %s", expr.Formula)
+		return nil
+	}
+
+	clog.Infof("Querying Prometheus for heatmap %s", formula)
+	metrics, _, err := Metrics(ctx, datasource, formula, queryTime, duration, step)
+	if err == nil && len(metrics) == 0 && len(alert.Labels) > 0 {
+		formula, _ = HistogramBucketsFormula(expr.Formula, nil)
+		clog.Infof("No buckets with alert labels, querying Prometheus %s", formula)
+		metrics, _, err = Metrics(ctx, datasource, formula, queryTime, duration, step)
+	}
+	if err != nil {
+		clog.Warnf("Failed to fetch heatmap for %s: %s", expr.Formula, err.Error())
+		return nil
+	}
+
+	return NewBucketHeatmap(metrics)
+}
+
+// bucketBounds identifies a histogram bucket. Classic buckets only know
+// their upper bound and are cumulative.
+type bucketBounds struct {
+	lower, upper float64
+	cumulative   bool
+}
+
+// bucketHeatmap draws the distribution of histogram buckets over time, one
+// cell per sample and bucket, shaded by the share of the busiest cell.
+type bucketHeatmap struct {
+	times        []float64
+	lower, upper []float64
+	// counts is indexed by time then bucket
+	counts  [][]float64
+	max     float64
+	palette []color.Color
+}
+
+// NewBucketHeatmap converts the result of a HistogramBucketsFormula query.
+// It returns nil when there are no buckets to draw.
+func NewBucketHeatmap(metrics model.Matrix) *bucketHeatmap {
+	counts := make(map[model.Time]map[bucketBounds]float64)
+	for _, sample := range metrics {
+		if le, ok := sample.Metric[model.BucketLabel]; ok {
+			upper, err := strconv.ParseFloat(string(le), 64)
+			if err != nil || math.IsInf(upper, 1) {
+				continue
+			}
+			for _, v := range sample.Values {
+				if counts[v.Timestamp] == nil {
+					counts[v.Timestamp] = make(map[bucketBounds]float64)
+				}
+				counts[v.Timestamp][bucketBounds{upper: upper, cumulative: true}] = float64(v.Value)
+			}
+			continue
+		}
+
+		for _, h := range sample.Histograms {
+			if counts[h.Timestamp] == nil {
+				counts[h.Timestamp] = make(map[bucketBounds]float64)
+			}
+			for _, bucket := range h.Histogram.Buckets {
+				if math.IsInf(float64(bucket.Upper), 1) || math.IsInf(float64(bucket.Lower), -1) {
+					continue
+				}
+				counts[h.Timestamp][bucketBounds{lower: float64(bucket.Lower), upper: float64(bucket.Upper)}] += float64(bucket.Count)
+			}
+		}
+	}
+
+	h := &bucketHeatmap{}
+	timestamps := make([]model.Time, 0, len(counts))
+	bounds := make(map[bucketBounds]bool)
+	for ts, buckets := range counts {
+		timestamps = append(timestamps, ts)
+		for bucket := range buckets {
+			bounds[bucket] = true
+		}
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	rows := make([]bucketBounds, 0, len(bounds))
+	for bucket := range bounds {
+		rows = append(rows, bucket)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].upper < rows[j].upper })
+
+	h.counts = make([][]float64, len(timestamps))
+	for i, ts := range timestamps {
+		h.times = append(h.times, float64(ts.Unix()))
+		buckets := counts[ts]
+		h.counts[i] = make([]float64, len(rows))
+		var previous float64
+		for j, row := range rows {
+			count := buckets[row]
+			if row.cumulative {
+				// classic buckets are cumulative
+				count, previous = count-previous, count
+			}
+			if math.IsNaN(count) || count < 0 {
+				count = 0
+			}
+			h.counts[i][j] = count
+		}
+	}
+
+	// drop buckets that are empty for the whole window
+	first, last := len(rows), -1
+	for _, column := range h.counts {
+		for j, count := range column {
+			if count > 0 {
+				first = int(math.Min(float64(first), float64(j)))
+				last = int(math.Max(float64(last), float64(j)))
+			}
+		}
+	}
+	if last < 0 {
+		return nil
+	}
+
+	for j := first; j <= last; j++ {
+		lower := rows[j].lower
+		if rows[j].cumulative && j > 0 {
+			lower = rows[j-1].upper
+		}
+		h.lower = append(h.lower, lower)
+		h.upper = append(h.upper, rows[j].upper)
+	}
+	for i := range h.counts {
+		h.counts[i] = h.counts[i][first : last+1]
+		for _, count := range h.counts[i] {
+			h.max = math.Max(h.max, count)
+		}
+	}
+
+	palette, err := brewer.GetPalette(brewer.TypeSequential, "YlOrRd", 9)
+	if err != nil {
+		clog.Warnf("Failed to get heatmap palette: %s", err.Error())
+		return nil
+	}
+	h.palette = palette.Colors()
+
+	return h
+}
+
+// Plot implements the plot.Plotter interface.
+func (h *bucketHeatmap) Plot(c draw.Canvas, p *plot.Plot) {
+	trX, trY := p.Transforms(&c)
+	_, logScale := p.Y.Scale.(plot.LogScale)
+
+	for i, t := range h.times {
+		// each sample covers the step before it
+		step := 0.0
+		if i > 0 {
+			step = t - h.times[i-1]
+		} else if len(h.times) > 1 {
+			step = h.times[1] - t
+		}
+
+		for j, count := range h.counts[i] {
+			if count == 0 {
+				continue
+			}
+			lower := h.lower[j]
+			if logScale && lower <= 0 {
+				lower = h.upper[j] / 2
+			}
+
+			shade := h.palette[int(count/h.max*float64(len(h.palette)-1))]
+			cell := []vg.Point{
+				{X: trX(t - step), Y: trY(lower)},
+				{X: trX(t), Y: trY(lower)},
+				{X: trX(t), Y: trY(h.upper[j])},
+				{X: trX(t - step), Y: trY(h.upper[j])},
+			}
+			c.FillPolygon(shade, c.ClipPolygonXY(cell))
+		}
+	}
+}
+
+// DataRange implements the plot.DataRanger interface. The lowest bucket
+// starting at zero is reported from half its upper bound to suit log scales.
+func (h *bucketHeatmap) DataRange() (xmin, xmax, ymin, ymax float64) {
+	ymin = h.lower[0]
+	if ymin <= 0 {
+		ymin = h.upper[0] / 2
+	}
+	return h.times[0], h.times[len(h.times)-1], ymin, h.upper[len(h.upper)-1]
+}
@@ -2,12 +2,13 @@ package main
 
 import (
 	"net/http/httputil"
-	"net/url"
 
 	"github.com/bugsnag/bugsnag-go/v2"
 	"github.com/bugsnag/microkit/clog"
 	"github.com/gin-gonic/gin"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
 	"github.com/spf13/viper"
 )
 
@@ -17,6 +18,25 @@ func healthz(c *gin.Context) {
 	})
 }
 
+func exposeMetrics(c *gin.Context) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		err = errors.Wrap(err, "Error gathering metrics")
+		_ = bugsnag.Notify(err, c.Request.Context())
+		clog.Error(err.Error())
+	}
+
+	format := expfmt.Negotiate(c.Request.Header)
+	c.Header("Content-Type", string(format))
+	encoder := expfmt.NewEncoder(c.Writer, format)
+	for _, family := range families {
+		if err := encoder.Encode(family); err != nil {
+			clog.Errorf("Error encoding metrics: %s", err.Error())
+			return
+		}
+	}
+}
+
 func webhook(c *gin.Context) {
 	ctx := c.Request.Context()
 	if viper.GetBool("debug") {
@@ -36,6 +56,26 @@ func webhook(c *gin.Context) {
 
 		for _, alert := range m.Alerts {
 			alertName := alert.Labels["alertname"]
+			alert.Receiver = m.Receiver
+
+			// from the generator url get the expressions to build the charts,
+			// before it is shortened
+			link, err := ParseGeneratorURL(alert.GeneratorURL)
+			if err != nil {
+				err = errors.Wrap(err, "Could not parse generator url")
+				_ = bugsnag.Notify(err, ctx,
+					bugsnag.MetaData{
+						"Alert": {
+							"Name":         alertName,
+							"GeneratorURL": alert.GeneratorURL,
+						},
+					})
+				clog.Error(err.Error())
+			}
+			// its host or datasource identifies the server
+			alert.Datasource = alert.ResolveDatasource(link)
+			alert.Rule = alert.LookupRule(ctx)
+
 			// shorten all alert annotation URLs
 			cli := NewLinksClient()
 			for k, txt := range alert.Annotations {
@@ -57,34 +97,6 @@ func webhook(c *gin.Context) {
 				alert.Annotations[k] = n
 			}
 
-			// get chart url
-			generatorUrl, err := url.Parse(alert.GeneratorURL)
-			if err != nil {
-				err = errors.Wrap(err, "Could not parse generator url")
-				_ = bugsnag.Notify(err, ctx,
-					bugsnag.MetaData{
-						"Alert": {
-							"Name":         alertName,
-							"GeneratorURL": alert.GeneratorURL,
-						},
-					})
-				clog.Error(err.Error())
-			}
-
-			// from the chart url get the expressions to build the charts
-			generatorQuery, err := url.ParseQuery(generatorUrl.RawQuery)
-			if err != nil {
-				err = errors.Wrap(err, "Could not parse query from generator url")
-				_ = bugsnag.Notify(err, ctx,
-					bugsnag.MetaData{
-						"Alert": {
-							"Name":     alertName,
-							"RawQuery": generatorUrl.RawQuery,
-						},
-					})
-				clog.Error(err.Error())
-			}
-
 			// shorten generator URL
 			n, err := cli.ReplaceLinks(ctx, alert.GeneratorURL)
 			if err != nil {
@@ -108,7 +120,7 @@ func webhook(c *gin.Context) {
 			}
 
 			// post new message
-			err = alert.PostMessage(generatorQuery)
+			err = alert.PostMessage(ctx, link)
 			if err != nil {
 				c.String(500, "%v", err)
 				err = errors.Wrap(err, "Error posting Slack message")
@@ -118,7 +130,7 @@ func webhook(c *gin.Context) {
 							"Name": alertName,
 						},
 						"Slack": {
-							"Query": generatorQuery,
+							"GeneratorLink": link,
 						},
 					})
 				clog.Error(err.Error())
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/config"
+	"go.yaml.in/yaml/v2"
+)
+
+// HTTPClientConfig configures how a server is queried. The keys other than
+// the tenant ones are the http_config of Prometheus scrape configs, so
+// settings can be copied over.
+type HTTPClientConfig struct {
+	// TenantLabel is the alert label holding the tenant to query as on
+	// multi-tenant servers such as Mimir or Cortex. Tenant is used for
+	// alerts without the label.
+	TenantLabel  string `mapstructure:"tenant_label"`
+	Tenant       string `mapstructure:"tenant"`
+	TenantHeader string `mapstructure:"tenant_header"`
+	// HTTPConfig holds the http_config keys, decoded by the Prometheus
+	// config package
+	HTTPConfig map[string]interface{} `mapstructure:",remain"`
+}
+
+// TenantFor returns the tenant to query as for an alert, empty when the
+// server isn't multi-tenant.
+func (cfg HTTPClientConfig) TenantFor(labels KV) string {
+	if tenant := labels[cfg.TenantLabel]; cfg.TenantLabel != "" && tenant != "" {
+		return tenant
+	}
+	return cfg.Tenant
+}
+
+// RoundTripper returns a transport applying the config to requests, sent
+// on behalf of tenant when it isn't empty. The name tells the clients
+// apart in connection metrics.
+func (cfg HTTPClientConfig) RoundTripper(name, tenant string) (http.RoundTripper, error) {
+	// through YAML, as the Prometheus config package only reads YAML keys
+	raw, err := yaml.Marshal(cfg.HTTPConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read HTTP config")
+	}
+	var httpConfig config.HTTPClientConfig
+	if err := yaml.UnmarshalStrict(raw, &httpConfig); err != nil {
+		return nil, errors.Wrap(err, "invalid HTTP config")
+	}
+
+	rt, err := config.NewRoundTripperFromConfig(httpConfig, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if tenant != "" {
+		tenantHeader := cfg.TenantHeader
+		if tenantHeader == "" {
+			tenantHeader = "X-Scope-OrgID"
+		}
+		rt = &tenantRoundTripper{header: tenantHeader, tenant: tenant, next: rt}
+	}
+
+	return rt, nil
+}
+
+type tenantRoundTripper struct {
+	header string
+	tenant string
+	next   http.RoundTripper
+}
+
+func (rt *tenantRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set(rt.header, rt.tenant)
+	return rt.next.RoundTrip(req)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	expressionParseFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "promalert",
+		Name:      "expression_parse_failures_total",
+		Help:      "Alert expressions that could not be parsed and were graphed without a threshold.",
+	})
+	graphsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "promalert",
+		Name:      "graphs_total",
+		Help:      "Graphs requested per outcome.",
+	}, []string{"outcome"})
+	queryRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "promalert",
+		Name:      "query_retries_total",
+		Help:      "Queries retried after a transient error, per datasource.",
+	}, []string{"datasource"})
+)
+
+const (
+	graphOutcomeRendered = "rendered"
+	graphOutcomeNoData   = "no_data"
+	graphOutcomeError    = "error"
+)
+
+func init() {
+	prometheus.MustRegister(expressionParseFailures, graphsTotal, queryRetries)
+}
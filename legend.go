@@ -0,0 +1,116 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+// Grafana style placeholders: $instance, ${instance} or {{instance}}. Only
+// the first two survive the templating of annotations by Prometheus.
+var labelPlaceholder = regexp.MustCompile(`\$([a-zA-Z_][a-zA-Z0-9_]*)|\$\{\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*\}|{{\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*}}`)
+
+// ExpandLabels replaces label placeholders with the label values, or
+// nothing for missing labels as Grafana does.
+func ExpandLabels(template string, labels map[string]string) string {
+	return labelPlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		m := labelPlaceholder.FindStringSubmatch(placeholder)
+		return labels[m[1]+m[2]+m[3]]
+	})
+}
+
+// LegendTexts returns the legend entry of each series, from the legend
+// template when set. Otherwise only the labels that tell the series apart
+// are listed, since the ones they share add nothing.
+func LegendTexts(metrics model.Matrix, legend string) []string {
+	texts := make([]string, len(metrics))
+	if legend != "" {
+		for i, sample := range metrics {
+			labels := make(map[string]string, len(sample.Metric))
+			for name, value := range sample.Metric {
+				labels[string(name)] = string(value)
+			}
+			texts[i] = strings.TrimSpace(ExpandLabels(legend, labels))
+		}
+		return texts
+	}
+
+	var differing []model.LabelName
+	for name := range labelNames(metrics) {
+		for _, sample := range metrics[1:] {
+			if sample.Metric[name] != metrics[0].Metric[name] {
+				differing = append(differing, name)
+				break
+			}
+		}
+	}
+	sort.Slice(differing, func(i, j int) bool { return differing[i] < differing[j] })
+
+	for i, sample := range metrics {
+		if len(differing) == 0 {
+			if m := labelText.FindStringSubmatch(sample.Metric.String()); m != nil {
+				texts[i] = m[1]
+			}
+			continue
+		}
+
+		pairs := make([]string, 0, len(differing))
+		for _, name := range differing {
+			if value, ok := sample.Metric[name]; ok {
+				pairs = append(pairs, string(name)+"="+strconv.Quote(string(value)))
+			}
+		}
+		texts[i] = strings.Join(pairs, ", ")
+	}
+
+	return texts
+}
+
+func labelNames(metrics model.Matrix) map[model.LabelName]bool {
+	names := make(map[model.LabelName]bool)
+	for _, sample := range metrics {
+		for name := range sample.Metric {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// WrapTitle breaks a title into lines of at most width characters, between
+// words where possible.
+func WrapTitle(title string, width int) string {
+	if width <= 0 {
+		return title
+	}
+
+	var lines []string
+	for _, paragraph := range strings.Split(title, "\n") {
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			for len(word) > width {
+				// expressions often have no spaces to break at
+				if line != "" {
+					lines = append(lines, line)
+					line = ""
+				}
+				lines = append(lines, word[:width])
+				word = word[width:]
+			}
+			switch {
+			case line == "":
+				line = word
+			case len(line)+1+len(word) <= width:
+				line += " " + word
+			default:
+				lines = append(lines, line)
+				line = word
+			}
+		}
+		lines = append(lines, line)
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestExpandLabels(t *testing.T) {
+	labels := map[string]string{"instance": "i1", "code": "500"}
+
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{template: "$instance", want: "i1"},
+		{template: "${code} on $instance", want: "500 on i1"},
+		{template: "{{instance}} {{ code }}", want: "i1 500"},
+		{template: "${ instance }:$code", want: "i1:500"},
+		{template: "$missing errors", want: " errors"},
+		{template: "no placeholders", want: "no placeholders"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			if got := ExpandLabels(tt.template, labels); got != tt.want {
+				t.Errorf("ExpandLabels(%q) = %q, want %q", tt.template, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLegendTexts(t *testing.T) {
+	tests := []struct {
+		name    string
+		metrics []model.Metric
+		legend  string
+		want    []string
+	}{
+		{
+			name: "template",
+			metrics: []model.Metric{
+				{"instance": "a", "code": "500"},
+				{"instance": "b"},
+			},
+			legend: "$instance ${code}",
+			want:   []string{"a 500", "b"},
+		},
+		{
+			name: "differing labels",
+			metrics: []model.Metric{
+				{"__name__": "x", "job": "api", "instance": "a", "code": "500"},
+				{"__name__": "x", "job": "api", "instance": "b", "code": "500"},
+				{"__name__": "x", "job": "api", "instance": "c"},
+			},
+			want: []string{`code="500", instance="a"`, `code="500", instance="b"`, `instance="c"`},
+		},
+		{
+			name:    "single series",
+			metrics: []model.Metric{{"__name__": "x", "job": "api"}},
+			want:    []string{`job="api"`},
+		},
+		{
+			name:    "no labels",
+			metrics: []model.Metric{{}},
+			want:    []string{""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var metrics model.Matrix
+			for _, metric := range tt.metrics {
+				metrics = append(metrics, &model.SampleStream{Metric: metric})
+			}
+			if got := LegendTexts(metrics, tt.legend); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("LegendTexts() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWrapTitle(t *testing.T) {
+	tests := []struct {
+		name  string
+		title string
+		width int
+		want  string
+	}{
+		{name: "short", title: "High error rate", width: 20, want: "High error rate"},
+		{name: "between words", title: "High error rate on api", width: 10, want: "High error\nrate on\napi"},
+		{name: "long word", title: "up rate(http_requests_total[5m])", width: 10, want: "up\nrate(http_\nrequests_t\notal[5m])"},
+		{name: "paragraphs", title: "High errors\nrate > 5", width: 20, want: "High errors\nrate > 5"},
+		{name: "no width", title: "High error rate on api", width: 0, want: "High error rate on api"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := WrapTitle(tt.title, tt.width); got != tt.want {
+				t.Errorf("WrapTitle(%q, %d) = %q, want %q", tt.title, tt.width, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bugsnag/bugsnag-go/v2"
+	"github.com/bugsnag/microkit/clog"
+	"github.com/pkg/errors"
+	"github.com/slack-go/slack"
+	"github.com/spf13/viper"
+)
+
+type LokiClient struct {
+	HTTPClient *http.Client
+	BaseURL    string
+	UserAgent  string
+}
+
+// LogLine is a line of a log stream.
+type LogLine struct {
+	Time time.Time
+	Line string
+}
+
+// NewLokiClient returns a client for `loki_url`, configured by
+// `loki_http_config` on behalf of the tenant of the alert.
+func NewLokiClient(alert Alert) (*LokiClient, error) {
+	var httpConfig HTTPClientConfig
+	if err := viper.UnmarshalKey("loki_http_config", &httpConfig); err != nil {
+		return nil, errors.Wrap(err, "Could not parse Loki HTTP config")
+	}
+	roundTripper, err := httpConfig.RoundTripper("loki", httpConfig.TenantFor(alert.Labels))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to configure Loki HTTP client")
+	}
+
+	var cli LokiClient
+	cli.BaseURL = strings.TrimSuffix(viper.GetString("loki_url"), "/")
+	cli.UserAgent = "promalert/v1 (+https://github.com/bugsnag/promalert)"
+	cli.HTTPClient = &http.Client{
+		Transport: roundTripper,
+		Timeout:   viper.GetDuration("loki_timeout"),
+	}
+	return &cli, nil
+}
+
+type lokiResponse struct {
+	Status string `json:"status"`
+	Data   struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][2]string       `json:"values"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+// QueryRange returns the latest limit lines matching a LogQL log query
+// between start and end, newest first.
+func (cli *LokiClient) QueryRange(ctx context.Context, query string, start, end time.Time, limit int) ([]LogLine, error) {
+	params := url.Values{}
+	params.Set("query", query)
+	params.Set("start", strconv.FormatInt(start.UnixNano(), 10))
+	params.Set("end", strconv.FormatInt(end.UnixNano(), 10))
+	params.Set("limit", strconv.Itoa(limit))
+	params.Set("direction", "backward")
+	reqURL := fmt.Sprintf("%s/loki/api/v1/query_range?%s", cli.BaseURL, params.Encode())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Create HTTP request: %w", err)
+	}
+	req.Header.Set("User-Agent", cli.UserAgent)
+
+	resp, err := cli.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Do HTTP request: %w", err)
+	}
+
+	defer func() {
+		if cerr := resp.Body.Close(); cerr != nil {
+			clog.Warnf("closing response body: %v", cerr)
+		}
+	}()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		buf, _ := io.ReadAll(resp.Body)
+		return nil, errors.Errorf("status code: %d, error: %s", resp.StatusCode, strings.TrimSpace(string(buf)))
+	}
+
+	var result lokiResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("parse http body: %w", err)
+	}
+	if result.Data.ResultType != "streams" {
+		return nil, errors.Errorf("not a log query, got %s result", result.Data.ResultType)
+	}
+
+	var lines []LogLine
+	for _, stream := range result.Data.Result {
+		for _, value := range stream.Values {
+			ns, err := strconv.ParseInt(value[0], 10, 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid log timestamp %s", value[0])
+			}
+			lines = append(lines, LogLine{Time: time.Unix(0, ns).UTC(), Line: value[1]})
+		}
+	}
+	// the limit applies to each stream, keep the latest lines overall
+	sort.SliceStable(lines, func(i, j int) bool { return lines[i].Time.After(lines[j].Time) })
+	if len(lines) > limit {
+		lines = lines[:limit]
+	}
+
+	return lines, nil
+}
+
+// LogQuery returns the LogQL query for the log excerpt of the alert, from
+// its logql annotation or else the logql template of its route. Both may
+// hold $label placeholders, which Prometheus leaves alone in annotations.
+func (alert Alert) LogQuery() (string, bool) {
+	query, ok := alert.Annotations["logql"]
+	if !ok {
+		query = GetRouteConfig(alert.Receiver).LogQL
+	}
+	query = strings.TrimSpace(ExpandLabels(query, alert.Labels))
+	return query, query != ""
+}
+
+// PostLogExcerpt replies in the thread of the alert message with the latest
+// log lines matching its LogQL query over the graphed time range. Alerts
+// without a query, or without `loki_url` set, get no reply.
+func (alert Alert) PostLogExcerpt(ctx context.Context, channel, threadTS string, queryTime time.Time, duration time.Duration) {
+	query, ok := alert.LogQuery()
+	if !ok || viper.GetString("loki_url") == "" {
+		return
+	}
+
+	lines, err := func() ([]LogLine, error) {
+		cli, err := NewLokiClient(alert)
+		if err != nil {
+			return nil, err
+		}
+		return cli.QueryRange(ctx, query, queryTime.Add(-duration), queryTime, viper.GetInt("log_lines"))
+	}()
+	if err != nil {
+		err = errors.Wrap(err, "Loki query error")
+		_ = bugsnag.Notify(err,
+			bugsnag.MetaData{
+				"Loki": {
+					"Query": query,
+				},
+				"Alert": {
+					"Name": alert.Labels["alertname"],
+				},
+			})
+		clog.Warn(err.Error())
+		return
+	}
+
+	_, respTimestamp, err := SlackSendAlertMessage(
+		viper.GetString("slack_token"),
+		channel,
+		slack.MsgOptionTS(threadTS),
+		slack.MsgOptionBlocks(ComposeLogExcerpt(query, lines)...),
+	)
+	if err != nil {
+		err = errors.Wrap(err, "Error posting log excerpt")
+		_ = bugsnag.Notify(err)
+		clog.Error(err.Error())
+		return
+	}
+
+	clog.Infof("Log excerpt sent, channel: %s timestamp: %s", channel, respTimestamp)
+}
+
+// ComposeLogExcerpt lists log lines in a code block, oldest first as in a
+// terminal. Lines that don't fit in the block are dropped, oldest first.
+func ComposeLogExcerpt(query string, lines []LogLine) []slack.Block {
+	header := fmt.Sprintf("*Logs* `%s`", escapeMrkdwn(query))
+	if len(lines) == 0 {
+		header += "\nNo matching log lines"
+	}
+
+	var excerpt []string
+	size := len(header) + len("\n```\n```")
+	for _, line := range lines {
+		text := escapeMrkdwn(line.Time.Format(time.RFC3339) + " " + strings.ReplaceAll(line.Line, "```", "'''"))
+		if size+len(text)+1 > MAX_TEXT_LENGTH {
+			break
+		}
+		size += len(text) + 1
+		excerpt = append([]string{text}, excerpt...)
+	}
+
+	text := header
+	if len(excerpt) > 0 {
+		text += "\n```\n" + strings.Join(excerpt, "\n") + "\n```"
+	}
+	textBlock := slack.NewTextBlockObject("mrkdwn", truncateText(text, MAX_TEXT_LENGTH), false, false)
+	return []slack.Block{slack.NewSectionBlock(textBlock, nil, nil)}
+}
+
+// escapeMrkdwn escapes the characters Slack reserves for links and mentions.
+func escapeMrkdwn(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// lokiStreams is a query_range response of two streams whose lines
+// interleave, each newest first as Loki returns them for a backward query.
+const lokiStreams = `{
+  "status": "success",
+  "data": {
+    "resultType": "streams",
+    "result": [
+      {"stream": {"pod": "a"}, "values": [["1700000004000000000", "a2 <error>"], ["1700000001000000000", "a1"]]},
+      {"stream": {"pod": "b"}, "values": [["1700000003000000000", "b2"], ["1700000002000000000", "b1 ` + "```" + `fence` + "```" + `"]]}
+    ]
+  }
+}`
+
+func newTestLokiClient(t *testing.T, handler http.HandlerFunc) *LokiClient {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return &LokiClient{HTTPClient: srv.Client(), BaseURL: srv.URL, UserAgent: "test"}
+}
+
+func TestQueryRange(t *testing.T) {
+	var query map[string][]string
+	cli := newTestLokiClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/loki/api/v1/query_range" {
+			http.NotFound(w, r)
+			return
+		}
+		query = r.URL.Query()
+		_, _ = w.Write([]byte(lokiStreams))
+	})
+
+	end := time.Unix(1700000010, 0)
+	lines, err := cli.QueryRange(context.Background(), `{app="api"}`, end.Add(-time.Hour), end, 3)
+	if err != nil {
+		t.Fatalf("QueryRange() error = %v", err)
+	}
+
+	for param, want := range map[string]string{
+		"query":     `{app="api"}`,
+		"limit":     "3",
+		"direction": "backward",
+		"end":       "1700000010000000000",
+	} {
+		if got := query[param]; len(got) != 1 || got[0] != want {
+			t.Errorf("param %s = %v, want %s", param, got, want)
+		}
+	}
+
+	// the latest 3 lines across both streams, newest first
+	var got []string
+	for _, line := range lines {
+		got = append(got, line.Line)
+	}
+	want := []string{"a2 <error>", "b2", "b1 ```fence```"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("QueryRange() lines = %q, want %q", got, want)
+	}
+	if !lines[0].Time.Equal(time.Unix(1700000004, 0)) {
+		t.Errorf("QueryRange() first time = %v", lines[0].Time)
+	}
+}
+
+func TestQueryRangeErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		wantErr string
+	}{
+		{
+			name:    "status",
+			status:  http.StatusBadRequest,
+			body:    "parse error at line 1",
+			wantErr: "status code: 400, error: parse error at line 1",
+		},
+		{
+			name:    "metric query",
+			status:  http.StatusOK,
+			body:    `{"status": "success", "data": {"resultType": "matrix", "result": []}}`,
+			wantErr: "not a log query, got matrix result",
+		},
+		{
+			name:    "timestamp",
+			status:  http.StatusOK,
+			body:    `{"status": "success", "data": {"resultType": "streams", "result": [{"stream": {}, "values": [["now", "x"]]}]}}`,
+			wantErr: "invalid log timestamp now",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cli := newTestLokiClient(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			})
+
+			_, err := cli.QueryRange(context.Background(), `{app="api"}`, time.Unix(0, 0), time.Unix(60, 0), 10)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("QueryRange() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestComposeLogExcerpt(t *testing.T) {
+	lines := []LogLine{
+		{Time: time.Unix(1700000004, 0).UTC(), Line: "a2 <error>"},
+		{Time: time.Unix(1700000002, 0).UTC(), Line: "b1 ```fence```"},
+	}
+
+	text := excerptText(t, ComposeLogExcerpt(`{app="api"} |= "<x>"`, lines))
+	want := "*Logs* `{app=\"api\"} |= \"&lt;x&gt;\"`\n```\n" +
+		"2023-11-14T22:13:22Z b1 '''fence'''\n" +
+		"2023-11-14T22:13:24Z a2 &lt;error&gt;\n```"
+	if text != want {
+		t.Errorf("ComposeLogExcerpt() =\n%s\nwant\n%s", text, want)
+	}
+}
+
+func TestComposeLogExcerptEmpty(t *testing.T) {
+	text := excerptText(t, ComposeLogExcerpt(`{app="api"}`, nil))
+	if want := "*Logs* `{app=\"api\"}`\nNo matching log lines"; text != want {
+		t.Errorf("ComposeLogExcerpt() = %q, want %q", text, want)
+	}
+}
+
+func TestComposeLogExcerptLimit(t *testing.T) {
+	// newest first, as returned by QueryRange
+	var lines []LogLine
+	for i := 0; i < 100; i++ {
+		lines = append(lines, LogLine{Time: time.Unix(int64(1000-i), 0).UTC(), Line: strings.Repeat("x", 50)})
+	}
+
+	text := excerptText(t, ComposeLogExcerpt(`{app="api"}`, lines))
+	if len(text) > MAX_TEXT_LENGTH {
+		t.Errorf("ComposeLogExcerpt() length = %d, want at most %d", len(text), MAX_TEXT_LENGTH)
+	}
+	if !strings.HasSuffix(text, "\n```") {
+		t.Errorf("ComposeLogExcerpt() doesn't close the code block: %q", text[len(text)-20:])
+	}
+	// the oldest lines are dropped, the newest is kept last
+	if newest := time.Unix(1000, 0).UTC().Format(time.RFC3339); !strings.Contains(text, newest+" x") {
+		t.Errorf("ComposeLogExcerpt() dropped the newest line %s", newest)
+	}
+	if oldest := time.Unix(901, 0).UTC().Format(time.RFC3339); strings.Contains(text, oldest) {
+		t.Errorf("ComposeLogExcerpt() kept the oldest line %s", oldest)
+	}
+}
+
+func TestLogQuery(t *testing.T) {
+	alert := Alert{
+		Labels:      KV{"namespace": "prod", "app": "api"},
+		Annotations: KV{"logql": `{namespace="$namespace", app="${app}", pod="$pod"} |= "error"`},
+	}
+
+	query, ok := alert.LogQuery()
+	if want := `{namespace="prod", app="api", pod=""} |= "error"`; !ok || query != want {
+		t.Errorf("LogQuery() = %q, %v, want %q", query, ok, want)
+	}
+}
+
+func excerptText(t *testing.T, blocks []slack.Block) string {
+	t.Helper()
+	if len(blocks) != 1 {
+		t.Fatalf("got %d blocks, want 1", len(blocks))
+	}
+	section, ok := blocks[0].(*slack.SectionBlock)
+	if !ok {
+		t.Fatalf("got %T, want a section block", blocks[0])
+	}
+	return section.Text.Text
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"time"
+
 	bugsnaggin "github.com/bugsnag/bugsnag-go/gin"
 	"github.com/bugsnag/bugsnag-go/v2"
 	"github.com/gin-gonic/gin"
@@ -24,6 +26,24 @@ func main() {
 	viper.AutomaticEnv()
 	viper.SetDefault("bugsnag_release_stage", "development")
 	viper.SetDefault("bugsnag_api_key", "")
+	viper.SetDefault("graph_scale", 1.0)
+	viper.SetDefault("title_wrap", 80)
+	viper.SetDefault("threshold_max_distance", 3.0)
+	viper.SetDefault("series_limit", 7)
+	viper.SetDefault("series_envelope_threshold", 50)
+	viper.SetDefault("label_pushdown", true)
+	viper.SetDefault("label_pushdown_exclude", []string{"alertname", "severity"})
+	viper.SetDefault("metric_resolution", 100)
+	viper.SetDefault("query_timeout", time.Second*30)
+	viper.SetDefault("query_retries", 2)
+	viper.SetDefault("query_retry_backoff", time.Millisecond*500)
+	viper.SetDefault("rules_lookup", true)
+	viper.SetDefault("rules_cache_ttl", time.Minute)
+	viper.SetDefault("grafana_render_timeout", time.Second*30)
+	viper.SetDefault("grafana_render_width", 1000)
+	viper.SetDefault("grafana_render_height", 500)
+	viper.SetDefault("loki_timeout", time.Second*30)
+	viper.SetDefault("log_lines", 20)
 	viper.SetEnvPrefix("promalert")
 
 	bugsnag.Configure(bugsnag.Configuration{
@@ -40,10 +60,11 @@ func main() {
 	g.Use(bugsnaggin.AutoNotify())
 
 	r := gin.New()
-	r.Use(gin.LoggerWithWriter(gin.DefaultWriter, "/healthz"))
+	r.Use(gin.LoggerWithWriter(gin.DefaultWriter, "/healthz", "/metrics"))
 	r.Use(gin.Recovery())
 
 	r.GET("/healthz", healthz)
+	r.GET("/metrics", exposeMetrics)
 	r.POST("/webhook", webhook)
 
 	err = r.Run(":" + viper.GetString("http_port"))
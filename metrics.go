@@ -3,34 +3,230 @@ package main
 // Metrics fetches data from Prometheus.
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
 	"time"
 
+	"github.com/bugsnag/microkit/clog"
 	"github.com/pkg/errors"
 	prometheus "github.com/prometheus/client_golang/api"
 	prometheusApi "github.com/prometheus/client_golang/api/prometheus/v1"
 	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/spf13/viper"
 )
 
-func Metrics(server, query string, queryTime time.Time, duration, step time.Duration) (model.Matrix, error) {
-	client, err := prometheus.NewClient(prometheus.Config{Address: server})
+// ErrUnexpectedResult is returned when a range query doesn't return a matrix.
+var ErrUnexpectedResult = errors.New("unexpected result type")
+
+// QueryError is returned when a datasource can't be queried, once retries
+// are exhausted.
+type QueryError struct {
+	Datasource string
+	Query      string
+	Err        error
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("failed to query %s for %s: %s", e.Datasource, e.Query, e.Err.Error())
+}
+
+func (e *QueryError) Unwrap() error {
+	return e.Err
+}
+
+// maxPoints is the most points Prometheus returns per series of a range
+// query, larger queries are rejected.
+const maxPoints = 11000
+
+// Metrics queries a formula over a time range every step, with the range
+// aligned to the step. Warnings, such as those of a partial response, are
+// returned along with the result.
+func Metrics(ctx context.Context, datasource Datasource, query string, queryTime time.Time, duration, step time.Duration) (model.Matrix, prometheusApi.Warnings, error) {
+	api, err := datasourceAPI(datasource)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to create Prometheus client")
+		return nil, nil, err
 	}
 
-	api := prometheusApi.NewAPI(client)
-	value, _, err := api.QueryRange(context.Background(), query, prometheusApi.Range{
-		Start: queryTime.Add(-duration),
-		End:   queryTime,
-		Step:  duration / step,
+	var value model.Value
+	var warnings prometheusApi.Warnings
+	err = withRetries(ctx, datasource, query, func(ctx context.Context) (err error) {
+		value, warnings, err = api.QueryRange(ctx, query, prometheusApi.Range{
+			Start: alignTime(queryTime.Add(-duration), step),
+			End:   alignTime(queryTime, step),
+			Step:  step,
+		})
+		return err
 	})
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to query Prometheus")
+		return nil, nil, err
+	}
+	for _, warning := range warnings {
+		clog.Warnf("Prometheus warning for %s: %s", query, warning)
 	}
 
 	metrics, ok := value.(model.Matrix)
 	if !ok {
-		return nil, errors.Wrap(err, "unsupported result format")
+		return nil, warnings, errors.Wrapf(ErrUnexpectedResult, "got %s", value.Type())
+	}
+
+	return metrics, warnings, nil
+}
+
+// QueryStep returns the step for graphing formula over duration with about
+// `metric_resolution` points. The step is a multiple of the minimum step,
+// `min_step` or else a quarter of the shortest range in the formula, as
+// finer steps only repeat the same samples.
+func QueryStep(formula string, duration time.Duration) time.Duration {
+	points := viper.GetInt64("metric_resolution")
+	if points <= 0 || points >= maxPoints {
+		// leave room for the extra point of a range ending on a step
+		points = maxPoints - 1
+	}
+	step := (duration + time.Duration(points) - 1) / time.Duration(points)
+
+	minStep := viper.GetDuration("min_step")
+	if minStep <= 0 {
+		minStep = shortestRange(formula) / 4
+	}
+	if minStep < time.Second {
+		minStep = time.Second
+	}
+
+	return (step + minStep - 1) / minStep * minStep
+}
+
+// shortestRange returns the shortest range vector or subquery range of a
+// formula, or 0 when it has none.
+func shortestRange(formula string) time.Duration {
+	expr, err := parser.ParseExpr(formula)
+	if err != nil {
+		return 0
+	}
+
+	var shortest time.Duration
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		var r time.Duration
+		switch n := node.(type) {
+		case *parser.MatrixSelector:
+			r = n.Range
+		case *parser.SubqueryExpr:
+			r = n.Range
+		}
+		if r > 0 && (shortest == 0 || r < shortest) {
+			shortest = r
+		}
+		return nil
+	})
+
+	return shortest
+}
+
+// alignTime rounds t down to a multiple of step since the epoch, so that
+// queries of overlapping windows share evaluation times and cached results.
+func alignTime(t time.Time, step time.Duration) time.Time {
+	return time.Unix(0, t.UnixNano()/int64(step)*int64(step))
+}
+
+// MetricMetadata fetches the type, help and unit of a metric from Prometheus.
+func MetricMetadata(ctx context.Context, datasource Datasource, metric string) ([]prometheusApi.Metadata, error) {
+	api, err := datasourceAPI(datasource)
+	if err != nil {
+		return nil, err
+	}
+
+	var metadata map[string][]prometheusApi.Metadata
+	err = withRetries(ctx, datasource, "metadata of "+metric, func(ctx context.Context) (err error) {
+		metadata, err = api.Metadata(ctx, metric, "1")
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return metadata[metric], nil
+}
+
+// withRetries runs a query within `query_timeout`, retrying errors the
+// server may recover from with an exponential backoff.
+func withRetries(ctx context.Context, datasource Datasource, query string, do func(context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, viper.GetDuration("query_timeout"))
+	defer cancel()
+
+	backoff := viper.GetDuration("query_retry_backoff")
+	for attempt := 0; ; attempt++ {
+		err := do(ctx)
+		if err == nil {
+			return nil
+		}
+		if attempt >= viper.GetInt("query_retries") || ctx.Err() != nil || !retryable(err) {
+			return &QueryError{Datasource: datasource.Name, Query: query, Err: err}
+		}
+
+		clog.Warnf("Retrying query to %s in %s: %s", datasource.Name, backoff, err.Error())
+		queryRetries.WithLabelValues(datasource.Name).Inc()
+		select {
+		case <-ctx.Done():
+			return &QueryError{Datasource: datasource.Name, Query: query, Err: err}
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// retryable tells transient errors, such as an overloaded server, a query
+// timing out on it or a refused or reset connection, from ones that will
+// happen again.
+func retryable(err error) bool {
+	var apiErr *prometheusApi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Type == prometheusApi.ErrServer || apiErr.Type == prometheusApi.ErrTimeout
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// Clients are kept per datasource so that connections and OAuth2 tokens are
+// reused across alerts.
+var datasourceAPIs = struct {
+	sync.Mutex
+	apis map[string]prometheusApi.API
+}{apis: make(map[string]prometheusApi.API)}
+
+func datasourceAPI(datasource Datasource) (prometheusApi.API, error) {
+	key, err := json.Marshal(datasource)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to identify datasource")
+	}
+
+	datasourceAPIs.Lock()
+	defer datasourceAPIs.Unlock()
+
+	if api, ok := datasourceAPIs.apis[string(key)]; ok {
+		return api, nil
+	}
+	api, err := newAPI(datasource)
+	if err != nil {
+		return nil, err
+	}
+	datasourceAPIs.apis[string(key)] = api
+	return api, nil
+}
+
+func newAPI(datasource Datasource) (prometheusApi.API, error) {
+	roundTripper, err := datasource.HTTP.RoundTripper(datasource.Name, datasource.Tenant)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to configure Prometheus HTTP client")
+	}
+
+	roundTripper = datasource.Query.RoundTripper(roundTripper)
+
+	client, err := prometheus.NewClient(prometheus.Config{Address: datasource.URL, RoundTripper: roundTripper})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create Prometheus client")
 	}
 
-	return metrics, nil
+	return prometheusApi.NewAPI(client), nil
 }
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestQueryStep(t *testing.T) {
+	tests := []struct {
+		name       string
+		formula    string
+		duration   time.Duration
+		resolution int
+		minStep    time.Duration
+		want       time.Duration
+	}{
+		{name: "instant vector", formula: "up", duration: time.Hour, resolution: 100, want: 36 * time.Second},
+		{name: "quarter of the range", formula: "rate(x[5m])", duration: time.Hour, resolution: 100, want: 75 * time.Second},
+		{name: "shortest range", formula: "rate(x[2m]) / rate(y[10m])", duration: time.Hour, resolution: 100, want: time.Minute},
+		{name: "subquery", formula: "max_over_time(up[20m:])", duration: time.Hour, resolution: 100, want: 5 * time.Minute},
+		{name: "configured minimum", formula: "rate(x[5m])", duration: time.Hour, resolution: 100, minStep: time.Minute, want: time.Minute},
+		{name: "at least a second", formula: "up", duration: time.Minute, resolution: 100, want: time.Second},
+		{name: "default resolution", formula: "up", duration: 30 * 24 * time.Hour, want: 236 * time.Second},
+		{name: "resolution above the limit", formula: "up", duration: 30 * 24 * time.Hour, resolution: 20000, want: 236 * time.Second},
+		{name: "unparseable", formula: "x >", duration: time.Hour, resolution: 100, want: 36 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Set("metric_resolution", tt.resolution)
+			viper.Set("min_step", tt.minStep)
+			if got := QueryStep(tt.formula, tt.duration); got != tt.want {
+				t.Errorf("QueryStep(%q, %v) = %v, want %v", tt.formula, tt.duration, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAlignTime(t *testing.T) {
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		t    time.Time
+		step time.Duration
+		want time.Time
+	}{
+		{name: "aligned", t: base, step: time.Minute, want: base},
+		{name: "rounded down", t: base.Add(59 * time.Second), step: time.Minute, want: base},
+		{name: "odd step", t: base.Add(80 * time.Second), step: 75 * time.Second, want: base.Add(75 * time.Second)},
+		{name: "sub-second", t: base.Add(1500 * time.Millisecond), step: time.Second, want: base.Add(time.Second)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := alignTime(tt.t, tt.step); !got.Equal(tt.want) {
+				t.Errorf("alignTime(%v, %v) = %v, want %v", tt.t, tt.step, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetricsRetries(t *testing.T) {
+	viper.Set("query_timeout", 5*time.Second)
+	viper.Set("query_retries", 2)
+	viper.Set("query_retry_backoff", time.Millisecond)
+
+	type response struct {
+		status int
+		body   string
+	}
+	success := response{http.StatusOK, `{"status": "success", "data": {"resultType": "matrix", "result": []}}`}
+	unavailable := response{http.StatusServiceUnavailable, "service unavailable"}
+
+	tests := []struct {
+		name         string
+		responses    []response
+		wantRequests int32
+		wantErr      bool
+	}{
+		{name: "success", responses: []response{success}, wantRequests: 1},
+		{name: "retried after 503", responses: []response{unavailable, success}, wantRequests: 2},
+		{
+			name:         "bad data",
+			responses:    []response{{http.StatusBadRequest, `{"status": "error", "errorType": "bad_data", "error": "parse error"}`}},
+			wantRequests: 1,
+			wantErr:      true,
+		},
+		{
+			name:         "execution error",
+			responses:    []response{{http.StatusUnprocessableEntity, `{"status": "error", "errorType": "execution", "error": "too many samples"}`}},
+			wantRequests: 1,
+			wantErr:      true,
+		},
+		{name: "retries exhausted", responses: []response{unavailable}, wantRequests: 3, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				i := int(atomic.AddInt32(&requests, 1)) - 1
+				if i >= len(tt.responses) {
+					i = len(tt.responses) - 1
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tt.responses[i].status)
+				_, _ = w.Write([]byte(tt.responses[i].body))
+			}))
+			defer srv.Close()
+
+			datasource := Datasource{Name: tt.name, URL: srv.URL}
+			_, _, err := Metrics(context.Background(), datasource, "up", time.Now(), time.Hour, time.Minute)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Metrics() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := atomic.LoadInt32(&requests); got != tt.wantRequests {
+				t.Errorf("Metrics() sent %d requests, want %d", got, tt.wantRequests)
+			}
+			if err == nil {
+				return
+			}
+			var queryErr *QueryError
+			if !errors.As(err, &queryErr) {
+				t.Fatalf("Metrics() error = %T, want *QueryError", err)
+			}
+			if queryErr.Datasource != tt.name || queryErr.Query != "up" {
+				t.Errorf("Metrics() error = %+v, want datasource %s and query up", queryErr, tt.name)
+			}
+		})
+	}
+}
+
+func TestRetriesConnectionRefused(t *testing.T) {
+	viper.Set("query_timeout", 5*time.Second)
+	viper.Set("query_retries", 2)
+	viper.Set("query_retry_backoff", time.Millisecond)
+
+	srv := httptest.NewServer(http.NotFoundHandler())
+	url := srv.URL
+	srv.Close()
+
+	attempts := 0
+	err := withRetries(context.Background(), Datasource{Name: "closed"}, "up", func(ctx context.Context) error {
+		attempts++
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	})
+	if err == nil {
+		t.Fatal("withRetries() error = nil")
+	}
+	if attempts != 3 {
+		t.Errorf("withRetries() made %d attempts, want 3", attempts)
+	}
+	var queryErr *QueryError
+	if !errors.As(err, &queryErr) {
+		t.Errorf("withRetries() error = %T, want *QueryError", err)
+	}
+}
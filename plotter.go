@@ -1,14 +1,19 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"image/color"
 	"io"
+	"math"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
+	prometheusApi "github.com/prometheus/client_golang/api/prometheus/v1"
 	"github.com/prometheus/prometheus/promql/parser"
 
 	"github.com/prometheus/common/model"
@@ -27,55 +32,264 @@ import (
 // Only show important part of metric name
 var labelText = regexp.MustCompile("{(.*)}")
 
-func GetPlotExpr(alertFormula string) []PlotExpr {
-	expr, _ := parser.ParseExpr(alertFormula)
-	if parenExpr, ok := expr.(*parser.ParenExpr); ok {
-		expr = parenExpr.Expr
-		clog.Infof("Removing redundant brackets: %v", expr.String())
+// ErrNoData is returned by QueryPanel when Prometheus has no samples for the formula.
+var ErrNoData = errors.New("no data")
+
+// GetPlotExpr breaks an alert expression into the formulas to graph. When the
+// expression can't be parsed, the raw expression is returned without a
+// threshold along with the parse error. An empty expression has nothing to
+// graph.
+func GetPlotExpr(alertFormula string) ([]PlotExpr, error) {
+	if strings.TrimSpace(alertFormula) == "" {
+		return nil, nil
 	}
 
-	if binaryExpr, ok := expr.(*parser.BinaryExpr); ok {
-		var alertOperator string
+	expr, err := parser.ParseExpr(alertFormula)
+	if err != nil {
+		clog.Warnf("Unparseable expression, drawing without threshold: %v", alertFormula)
+		return []PlotExpr{{Formula: alertFormula}}, errors.Wrap(err, "failed to parse alert expression")
+	}
 
-		switch binaryExpr.Op {
-		case parser.LAND:
+	return plotExprs(expr), nil
+}
+
+func plotExprs(expr parser.Expr) []PlotExpr {
+	expr = unwrapParens(expr)
+
+	switch e := expr.(type) {
+	case *parser.BinaryExpr:
+		switch {
+		case e.Op == parser.LAND:
 			clog.Warn("Logical condition, drawing sides separately")
-			return append(GetPlotExpr(binaryExpr.LHS.String()), GetPlotExpr(binaryExpr.RHS.String())...)
-		case parser.LTE, parser.LSS:
-			alertOperator = "<"
-		case parser.GTE, parser.GTR:
-			alertOperator = ">"
-		default:
-			clog.Infof("Unexpected operator: %v", binaryExpr.Op.String())
-			alertOperator = ">"
-		}
-
-		alertLevel, _ := strconv.ParseFloat(binaryExpr.RHS.String(), 64)
-		return []PlotExpr{PlotExpr{
-			Formula:  binaryExpr.LHS.String(),
-			Operator: alertOperator,
-			Level:    alertLevel,
-		}}
-	} else {
-		clog.Infof("Non binary expression: %v", alertFormula)
-		return nil
+			return append(plotExprs(e.LHS), plotExprs(e.RHS)...)
+		case e.Op == parser.LOR:
+			clog.Warn("Alternative condition, drawing sides separately")
+			return append(plotExprs(e.LHS), plotExprs(e.RHS)...)
+		case e.Op == parser.LUNLESS:
+			clog.Info("Exclusion condition, drawing left side only")
+			return plotExprs(e.LHS)
+		case e.Op.IsComparisonOperator():
+			return comparisonPlotExprs(e)
+		}
+	case *parser.AggregateExpr:
+		// min/max/topk/bottomk pick values without changing them, so the
+		// comparison can be lifted out of the aggregation: max(x > 5) is
+		// drawn as max(x) against 5. The aggregation fires when any series
+		// crosses the threshold, so the side of the extreme series facing it
+		// is drawn: min(x > 5) as max(x) and max(x < 5) as min(x).
+		switch e.Op {
+		case parser.MAX, parser.MIN, parser.TOPK, parser.BOTTOMK:
+			if cmp, ok := unwrapParens(e.Expr).(*parser.BinaryExpr); ok && cmp.Op.IsComparisonOperator() && !cmp.ReturnBool {
+				if vector, operator, level, ok := splitComparison(cmp); ok && (operator == ">" || operator == "<") {
+					lifted := *e
+					lifted.Op = liftedAggregation(e.Op, operator)
+					lifted.Expr = vector
+					clog.Infof("Lifting comparison out of aggregation: %v", e.String())
+					return []PlotExpr{{
+						Formula:  lifted.String(),
+						Operator: operator,
+						Level:    level,
+					}}
+				}
+			}
+		}
+	}
+
+	clog.Infof("Non comparison expression, drawing without threshold: %v", expr.String())
+	return append([]PlotExpr{{Formula: expr.String()}}, nestedPlotExprs(expr)...)
+}
+
+// liftedAggregation returns the aggregation selecting the series closest to
+// crossing a threshold from the side of operator: max or topk for >, min or
+// bottomk for <.
+func liftedAggregation(op parser.ItemType, operator string) parser.ItemType {
+	switch {
+	case operator == ">" && op == parser.MIN:
+		return parser.MAX
+	case operator == ">" && op == parser.BOTTOMK:
+		return parser.TOPK
+	case operator == "<" && op == parser.MAX:
+		return parser.MIN
+	case operator == "<" && op == parser.TOPK:
+		return parser.BOTTOMK
+	}
+	return op
+}
+
+// comparisonPlotExprs draws the vector side of a comparison against its
+// scalar side, followed by any comparisons nested inside the vector side,
+// e.g. count(x > 5) > 3 is drawn as count(x > 5) against 3 and x against 5.
+func comparisonPlotExprs(cmp *parser.BinaryExpr) []PlotExpr {
+	vector, operator, level, ok := splitComparison(cmp)
+	if !ok {
+		clog.Infof("Comparing two vectors, drawing sides separately: %v", cmp.String())
+		return append(plotExprs(cmp.LHS), plotExprs(cmp.RHS)...)
+	}
+
+	// (x > bool 5) == 1 fires exactly when x > 5 does
+	if inner, ok := vector.(*parser.BinaryExpr); ok && inner.ReturnBool {
+		if (operator == "==" && level == 1) || (operator == "!=" && level == 0) || (operator == ">" && level == 0) {
+			clog.Infof("Unwrapping bool comparison: %v", cmp.String())
+			return comparisonPlotExprs(inner)
+		}
+	}
+
+	if cmp.ReturnBool {
+		clog.Infof("Bool modifier, drawing as plain comparison: %v", cmp.String())
+	}
+
+	return append([]PlotExpr{{
+		Formula:  vector.String(),
+		Operator: operator,
+		Level:    level,
+	}}, nestedPlotExprs(vector)...)
+}
+
+// splitComparison returns the vector side of a comparison together with the
+// operator and level as seen from that side, flipping the operator when the
+// scalar is on the left: 5 < x is the same as x > 5.
+func splitComparison(cmp *parser.BinaryExpr) (parser.Expr, string, float64, bool) {
+	if level, ok := scalarValue(cmp.RHS); ok {
+		return unwrapParens(cmp.LHS), comparisonOperator(cmp.Op, false), level, true
+	}
+	if level, ok := scalarValue(cmp.LHS); ok {
+		return unwrapParens(cmp.RHS), comparisonOperator(cmp.Op, true), level, true
+	}
+
+	return nil, "", 0, false
+}
+
+func comparisonOperator(op parser.ItemType, flip bool) string {
+	switch op {
+	case parser.EQLC:
+		return "=="
+	case parser.NEQ:
+		return "!="
+	case parser.LSS, parser.LTE:
+		if flip {
+			return ">"
+		}
+		return "<"
+	case parser.GTR, parser.GTE:
+		if flip {
+			return "<"
+		}
+		return ">"
+	default:
+		clog.Infof("Unexpected operator: %v", op.String())
+		return ">"
+	}
+}
+
+// nestedPlotExprs finds comparisons inside an expression that is not itself
+// a comparison, such as the x > 5 in count(x > 5).
+func nestedPlotExprs(expr parser.Expr) []PlotExpr {
+	var exprs []PlotExpr
+	for _, child := range parser.Children(expr) {
+		childExpr, ok := child.(parser.Expr)
+		if !ok {
+			continue
+		}
+		if cmp, ok := unwrapParens(childExpr).(*parser.BinaryExpr); ok && cmp.Op.IsComparisonOperator() {
+			if _, _, _, ok := splitComparison(cmp); ok {
+				exprs = append(exprs, comparisonPlotExprs(cmp)...)
+				continue
+			}
+		}
+		exprs = append(exprs, nestedPlotExprs(childExpr)...)
+	}
+
+	return exprs
+}
+
+func unwrapParens(expr parser.Expr) parser.Expr {
+	for {
+		parenExpr, ok := expr.(*parser.ParenExpr)
+		if !ok {
+			return expr
+		}
+		expr = parenExpr.Expr
+		clog.Infof("Removing redundant brackets: %v", expr.String())
+	}
+}
+
+// scalarValue evaluates constant scalar expressions such as 5, -5 or (0.5 * 100).
+func scalarValue(expr parser.Expr) (float64, bool) {
+	switch e := unwrapParens(expr).(type) {
+	case *parser.NumberLiteral:
+		return e.Val, true
+	case *parser.UnaryExpr:
+		v, ok := scalarValue(e.Expr)
+		if ok && e.Op == parser.SUB {
+			v = -v
+		}
+		return v, ok
+	case *parser.BinaryExpr:
+		lhs, ok := scalarValue(e.LHS)
+		if !ok {
+			return 0, false
+		}
+		rhs, ok := scalarValue(e.RHS)
+		if !ok {
+			return 0, false
+		}
+		switch e.Op {
+		case parser.ADD:
+			return lhs + rhs, true
+		case parser.SUB:
+			return lhs - rhs, true
+		case parser.MUL:
+			return lhs * rhs, true
+		case parser.DIV:
+			return lhs / rhs, true
+		case parser.POW:
+			return math.Pow(lhs, rhs), true
+		}
 	}
+
+	return 0, false
 }
 
-func Plot(expr PlotExpr, queryTime time.Time, duration, resolution time.Duration, prometheusUrl string, alert Alert) (io.WriterTo, error) {
-	clog.Infof("Querying Prometheus %s", expr.Formula)
-	metrics, err := Metrics(
-		prometheusUrl,
-		expr.Formula,
+// QueryPanel fetches everything drawn on the graph of an expression.
+func QueryPanel(ctx context.Context, expr PlotExpr, opts PlotOptions, queryTime time.Time, duration, step time.Duration, datasource Datasource, alert Alert) (Panel, error) {
+	queried := expr
+	if viper.GetBool("label_pushdown") {
+		formula, ok, err := InjectLabels(expr.Formula, alert.Labels)
+		if err != nil {
+			clog.Infof("Can't push alert labels into query: %s", err.Error())
+		} else if ok {
+			queried.Formula = formula
+		}
+	}
+
+	clog.Infof("Querying Prometheus %s", queried.Formula)
+	metrics, warnings, err := Metrics(
+		ctx,
+		datasource,
+		queried.Formula,
 		queryTime,
 		duration,
-		resolution,
+		step,
 	)
+	if err == nil && len(metrics) == 0 && queried.Formula != expr.Formula {
+		// alert labels added by the rule or external labels aren't on the
+		// series, query without them and match series client-side instead
+		clog.Infof("No data with alert labels, querying Prometheus %s", expr.Formula)
+		queried = expr
+		metrics, warnings, err = Metrics(
+			ctx,
+			datasource,
+			queried.Formula,
+			queryTime,
+			duration,
+			step,
+		)
+	}
 	if err != nil {
 		_ = bugsnag.Notify(err,
 			bugsnag.MetaData{
 				"Expression": {
-					"PrometheusUrl":      prometheusUrl,
+					"PrometheusUrl":      datasource.URL,
 					"ExpressionFormula":  expr.Formula,
 					"ExpressionOperator": expr.Operator,
 					"QueryTime":          queryTime.String(),
@@ -87,63 +301,103 @@ func Plot(expr PlotExpr, queryTime time.Time, duration, resolution time.Duration
 					"MessageTS":    alert.MessageTS,
 				},
 			})
-		return nil, err
+		return Panel{}, err
 	}
 
-	var selectedMetrics model.Matrix
-	var found bool
-	for _, metric := range metrics {
-		clog.Infof("Metric fetched: %v", metric.Metric)
-		found = false
-		for label, value := range metric.Metric {
-			if originValue, ok := alert.Labels[string(label)]; ok {
-				if originValue == string(value) {
-					found = true
-				} else {
-					found = false
-					break
-				}
-			}
-		}
+	if len(metrics) == 0 {
+		clog.Infof("No data for %s", expr.Formula)
+		return Panel{}, ErrNoData
+	}
+
+	selectedMetrics, seriesNote := SelectSeries(metrics, alert, opts)
+	var graphNotes []string
+	if note, ok := partialResponseNote(warnings); ok {
+		graphNotes = append(graphNotes, note)
+	}
+	if seriesNote != "" {
+		clog.Infof("Series selected: %s", seriesNote)
+		graphNotes = append(graphNotes, seriesNote)
+	}
 
-		if found {
-			clog.Infof("Best match found: %v", metric.Metric)
-			selectedMetrics = model.Matrix{metric}
-			break
+	var comparison model.Matrix
+	if offset, ok := opts.CompareDuration(); ok {
+		comparison, err = ComparisonMetrics(ctx, queried, offset, selectedMetrics, queryTime, duration, step, datasource)
+		if err != nil {
+			// the graph is still useful without the overlay
+			clog.Warnf("Failed to fetch comparison for %s: %s", expr.Formula, err.Error())
+			_ = bugsnag.Notify(errors.Wrap(err, "comparison query failed"),
+				bugsnag.MetaData{
+					"Expression": {
+						"PrometheusUrl":     datasource.URL,
+						"ExpressionFormula": expr.Formula,
+						"CompareOffset":     opts.CompareOffset,
+					},
+				})
 		}
 	}
 
-	if !found {
-		clog.Infof("Best match not found, use entire dataset. Labels to search: %v", alert.Labels)
-		selectedMetrics = metrics
+	var heatmap *bucketHeatmap
+	if opts.Heatmap {
+		heatmap = histogramHeatmap(ctx, expr, queryTime, duration, step, datasource, alert)
 	}
 
-	clog.Infof("Creating plot: %s", alert.Annotations["summary"])
-	plottedMetric, err := PlotMetric(selectedMetrics, expr.Level, expr.Operator)
-	if err != nil {
-		_ = bugsnag.Notify(err,
-			bugsnag.MetaData{
-				"Expression": {
-					"PrometheusUrl":      prometheusUrl,
-					"ExpressionFormula":  expr.Formula,
-					"ExpressionOperator": expr.Operator,
-					"QueryTime":          queryTime.String(),
-				},
-				"Alert": {
-					"Name":         alert.Labels["name"],
-					"GeneratorURL": alert.GeneratorURL,
-					"Channel":      alert.Channel,
-					"MessageTS":    alert.MessageTS,
-				},
-			})
-		return nil, err
+	return Panel{
+		Data: PlotData{
+			Metrics:    selectedMetrics,
+			Comparison: comparison,
+			Heatmap:    heatmap,
+			Notes:      graphNotes,
+		},
+		Expr: expr,
+		Opts: opts,
+	}, nil
+}
+
+// partialResponseNote flags results missing data from some stores, which
+// Thanos and query frontends report as warnings. PromQL warnings about the
+// query itself don't affect the data.
+func partialResponseNote(warnings prometheusApi.Warnings) (string, bool) {
+	for _, warning := range warnings {
+		if strings.HasPrefix(warning, "PromQL") {
+			continue
+		}
+		if len(warning) > 80 {
+			warning = warning[:80] + "..."
+		}
+		return "partial response: " + warning, true
 	}
+	return "", false
+}
+
+// PlotData is everything drawn on a graph besides the threshold.
+type PlotData struct {
+	Metrics model.Matrix
+	// Comparison series, evaluated at the same times as the metrics, are
+	// drawn as faded dashed lines behind them
+	Comparison model.Matrix
+	// Heatmap of the histogram buckets, drawn behind everything else
+	Heatmap *bucketHeatmap
+	// Notes are written in a corner of the graph
+	Notes []string
+}
 
-	return plottedMetric, nil
+// PlotMetric draws the metrics against the alert threshold.
+func PlotMetric(data PlotData, expr PlotExpr, opts PlotOptions) (io.WriterTo, error) {
+	return PlotPanels(Panel{Data: data, Expr: expr, Opts: opts})
 }
 
-func PlotMetric(metrics model.Matrix, level float64, direction string) (io.WriterTo, error) {
-	viper.SetDefault("graph_scale", 1.0)
+// Panel is the graph of a single expression.
+type Panel struct {
+	Data PlotData
+	Expr PlotExpr
+	Opts PlotOptions
+	// Title is written above the graph when set
+	Title string
+}
+
+// PlotPanels draws panels into a single image, in a grid of up to two
+// columns. The panels share their time axis so they can be compared.
+func PlotPanels(panels ...Panel) (io.WriterTo, error) {
 	var graphScale = viper.GetFloat64("graph_scale")
 
 	textFontDef := font.Font{Typeface: "Liberation", Variant: "Mono"}
@@ -153,22 +407,92 @@ func PlotMetric(metrics model.Matrix, level float64, direction string) (io.Write
 		return nil, errors.New("failed to lookup text font")
 	}
 	evalTextFont := font.DefaultCache.Lookup(textFontDef, vg.Length(3*graphScale)*vg.Millimeter)
-	evalTextStyle := draw.TextStyle{
-		Color:   color.NRGBA{A: 150},
-		Font:    evalTextFont.Font,
-		XAlign:  draw.XRight,
-		YAlign:  draw.YBottom,
-		Handler: plot.DefaultTextHandler,
+
+	plots := make([]*panelPlot, 0, len(panels))
+	xMin, xMax := math.Inf(1), math.Inf(-1)
+	for _, panel := range panels {
+		pp, err := newPanelPlot(panel, textFont, graphScale)
+		if err != nil {
+			return nil, err
+		}
+		plots = append(plots, pp)
+		xMin = math.Min(xMin, pp.plot.X.Min)
+		xMax = math.Max(xMax, pp.plot.X.Max)
+	}
+	for _, pp := range plots {
+		pp.plot.X.Min, pp.plot.X.Max = xMin, xMax
+		if err := pp.addThreshold(); err != nil {
+			return nil, err
+		}
+	}
+
+	cols := 1
+	if len(plots) > 1 {
+		cols = 2
+	}
+	rows := (len(plots) + cols - 1) / cols
+
+	// Draw plot in canvas with margin
+	margin := vg.Length(3*graphScale) * vg.Millimeter
+	width := vg.Length(12*graphScale) * vg.Centimeter * vg.Length(cols)
+	height := vg.Length(6*graphScale) * vg.Centimeter * vg.Length(rows)
+	c, err := draw.NewFormattedCanvas(width, height, "png")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create canvas")
+	}
+
+	croppedCanvas := draw.Crop(draw.New(c), margin, -margin, margin, -margin)
+	grid := make([][]*plot.Plot, rows)
+	for row := range grid {
+		grid[row] = make([]*plot.Plot, cols)
+	}
+	for i, pp := range plots {
+		grid[i/cols][i%cols] = pp.plot
+	}
+	canvases := plot.Align(grid, draw.Tiles{Rows: rows, Cols: cols, PadX: margin, PadY: margin}, croppedCanvas)
+	for i, pp := range plots {
+		pp.draw(canvases[i/cols][i%cols], textFont, evalTextFont)
+	}
+
+	return c, nil
+}
+
+// panelPlot is a panel on its way to be drawn, keeping what is written
+// over the graph once the axes are laid out.
+type panelPlot struct {
+	plot          *plot.Plot
+	panel         Panel
+	lastEvalValue float64
+	violations    plotter.XYs
+	offScale      int
+}
+
+// newPanelPlot adds the series of a panel to a new plot.
+func newPanelPlot(panel Panel, textFont font.Face, graphScale float64) (*panelPlot, error) {
+	metrics, expr, opts := panel.Data.Metrics, panel.Expr, panel.Opts
+	if opts.LogScale && !hasPositiveValues(metrics) {
+		// decided before drawing, as log scale leaves out the other values
+		clog.Warn("No positive values to draw on log scale, using linear scale")
+		opts.LogScale = false
+		panel.Opts = opts
 	}
 
 	p := plot.New()
-	//p.Y.Min = 0
 	p.X.Tick.Marker = plot.TimeTicks{Format: "15:04:05"}
 	p.X.Tick.Label.Font = textFont.Font
 	p.Y.Tick.Label.Font = textFont.Font
+	p.Y.Tick.Marker = unitTicks{Ticker: plot.DefaultTicks{}, Unit: expr.Unit}
 	p.Legend.TextStyle.Font = textFont.Font
 	p.Legend.Top = true
-	p.Legend.YOffs = vg.Length(15*graphScale) * vg.Millimeter
+	// inside the top right corner, clear of the threshold label
+	p.Legend.XOffs = -vg.Millimeter
+	p.Legend.YOffs = -vg.Millimeter
+	if panel.Title != "" {
+		// fit the title to the width of the graph
+		width := vg.Length(12*graphScale)*vg.Centimeter - 2*vg.Length(3*graphScale)*vg.Millimeter
+		p.Title.Text = WrapTitle(panel.Title, int(width/textFont.Width("m")))
+		p.Title.TextStyle.Font = textFont.Font
+	}
 
 	// Color palette for drawing lines
 	paletteSize := 8
@@ -178,14 +502,33 @@ func PlotMetric(metrics model.Matrix, level float64, direction string) (io.Write
 	}
 	colors := palette.Colors()
 
-	var lastEvalValue float64
+	if panel.Data.Heatmap != nil {
+		p.Add(panel.Data.Heatmap)
+	}
+	if err := drawComparison(p, panel.Data.Comparison, metrics, colors, opts); err != nil {
+		return nil, err
+	}
+
+	pp := &panelPlot{plot: p, panel: panel}
+
+	// a single series needs no legend
+	legends := make([]string, len(metrics))
+	if len(metrics) > 1 {
+		legends = LegendTexts(metrics, opts.Legend)
+	}
 
 	for s, sample := range metrics {
 		data := make(plotter.XYs, 0)
 		for _, v := range sample.Values {
 			fs := v.Value.String()
-			if fs == "NaN" {
-				_, err := drawLine(data, colors, s, paletteSize, p, metrics, sample)
+			f, err := strconv.ParseFloat(fs, 64)
+			if err != nil {
+				return nil, errors.Wrap(err, "sample value not float: "+v.Value.String())
+			}
+
+			// log scale can't show zero or negative values, leave a gap as for NaN
+			if math.IsNaN(f) || (opts.LogScale && f <= 0) {
+				_, err := drawLine(data, colors, s, paletteSize, p, legends[s])
 				if err != nil {
 					return nil, errors.Wrapf(err, "failed to draw line for value: %s", v.Value.String())
 				}
@@ -194,23 +537,273 @@ func PlotMetric(metrics model.Matrix, level float64, direction string) (io.Write
 				continue
 			}
 
-			f, err := strconv.ParseFloat(fs, 64)
-			if err != nil {
-				return nil, errors.Wrap(err, "sample value not float: "+v.Value.String())
-			}
 			data = append(data, plotter.XY{X: float64(v.Timestamp.Unix()), Y: f})
-			lastEvalValue = f
+			pp.lastEvalValue = f
+
+			if (expr.Operator == "==" && f == expr.Level) || (expr.Operator == "!=" && f != expr.Level) {
+				pp.violations = append(pp.violations, plotter.XY{X: float64(v.Timestamp.Unix()), Y: f})
+			}
 		}
 
-		_, err := drawLine(data, colors, s, paletteSize, p, metrics, sample)
+		_, err := drawLine(data, colors, s, paletteSize, p, legends[s])
 		if err != nil {
 			return nil, err
 		}
 	}
 
+	return pp, nil
+}
+
+// hasPositiveValues tells whether any sample can be drawn on log scale.
+func hasPositiveValues(metrics model.Matrix) bool {
+	for _, sample := range metrics {
+		for _, v := range sample.Values {
+			if float64(v.Value) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// addThreshold fits the Y axis and adds the threshold shapes, which span
+// the time axis so are added once it is final.
+func (pp *panelPlot) addThreshold() error {
+	p, expr := pp.plot, pp.panel.Expr
+	for _, sibling := range expr.Siblings {
+		applyYRange(p, sibling, pp.panel.Opts)
+	}
+	pp.offScale = applyYRange(p, expr, pp.panel.Opts)
+
+	var err error
+	switch {
+	case len(expr.Siblings) > 0:
+		err = drawSeverityBands(p, expr)
+	case expr.Operator == "<" || expr.Operator == ">":
+		err = drawThresholdZone(p, pp.panel.Data.Metrics, expr)
+	case expr.Operator == "==" || expr.Operator == "!=":
+		err = drawViolations(p, pp.violations)
+	}
+	if err != nil {
+		return err
+	}
+	if expr.HasThreshold() && pp.offScale == 0 {
+		if err := drawThresholdLine(p, expr); err != nil {
+			return err
+		}
+	}
+	p.Add(plotter.NewGrid())
+
+	return nil
+}
+
+// draw draws the plot in c, then writes the latest value, the threshold
+// and the notes over it.
+func (pp *panelPlot) draw(c draw.Canvas, textFont, evalTextFont font.Face) {
+	p, expr := pp.plot, pp.panel.Expr
+	p.Draw(c)
+
+	// Draw last evaluated value
+	evalText := fmt.Sprintf("latest evaluation: %s", FormatValue(pp.lastEvalValue, expr.Unit))
+	evalTextStyle := draw.TextStyle{
+		Color:   color.NRGBA{A: 150},
+		Font:    evalTextFont.Font,
+		XAlign:  draw.XRight,
+		YAlign:  draw.YBottom,
+		Handler: plot.DefaultTextHandler,
+	}
+
+	plotterCanvas := p.DataCanvas(c)
+
+	trX, trY := p.Transforms(&plotterCanvas)
+	evalRectangle := evalTextStyle.Rectangle(evalText)
+
+	points := []vg.Point{
+		{X: trX(p.X.Max) + evalRectangle.Min.X - 8*vg.Millimeter, Y: trY(pp.lastEvalValue) + evalRectangle.Min.Y - vg.Millimeter},
+		{X: trX(p.X.Max) + evalRectangle.Min.X - 8*vg.Millimeter, Y: trY(pp.lastEvalValue) + evalRectangle.Max.Y + vg.Millimeter},
+		{X: trX(p.X.Max) + evalRectangle.Max.X - 6*vg.Millimeter, Y: trY(pp.lastEvalValue) + evalRectangle.Max.Y + vg.Millimeter},
+		{X: trX(p.X.Max) + evalRectangle.Max.X - 6*vg.Millimeter, Y: trY(pp.lastEvalValue) + evalRectangle.Min.Y - vg.Millimeter},
+	}
+	plotterCanvas.FillPolygon(color.NRGBA{R: 255, G: 255, B: 255, A: 90}, points)
+	plotterCanvas.FillText(evalTextStyle, vg.Point{X: trX(p.X.Max) - 6*vg.Millimeter, Y: trY(pp.lastEvalValue)}, evalText)
+
+	labelStyle := draw.TextStyle{
+		Color:   color.NRGBA{R: 200, A: 200},
+		Font:    textFont.Font,
+		XAlign:  draw.XLeft,
+		Handler: plot.DefaultTextHandler,
+	}
+	if expr.HasThreshold() {
+		drawThresholdLabel(plotterCanvas, p, expr, pp.offScale, labelStyle)
+	}
+	for _, sibling := range expr.Siblings {
+		// off-scale siblings are left to the band of the nearest threshold
+		if sibling.Level >= p.Y.Min && sibling.Level <= p.Y.Max {
+			drawThresholdLabel(plotterCanvas, p, sibling, 0, labelStyle)
+		}
+	}
+
+	notes := append([]string{}, pp.panel.Data.Notes...)
+	if len(pp.panel.Data.Comparison) > 0 {
+		notes = append(notes, fmt.Sprintf("dashed: %s ago", pp.panel.Opts.CompareOffset))
+	}
+	if pp.panel.Data.Heatmap != nil {
+		notes = append(notes, "shaded: histogram buckets")
+	}
+	notesBottom := plotterCanvas.Min.Y + vg.Millimeter
+	if pp.offScale == -1 {
+		// keep clear of the off-scale indicator
+		notesBottom += labelStyle.Height("threshold") + vg.Millimeter
+	}
+	drawGraphNotes(plotterCanvas, notes, notesBottom, draw.TextStyle{
+		Color:   color.NRGBA{A: 150},
+		Font:    textFont.Font,
+		XAlign:  draw.XLeft,
+		YAlign:  draw.YBottom,
+		Handler: plot.DefaultTextHandler,
+	})
+}
+
+// applyYRange fits the Y axis to the plot options and makes room for the
+// threshold, unless it is so far from the data that including it would
+// flatten the lines. It returns 1 or -1 when the threshold is left above or
+// below the axis, 0 when it is visible. Threshold shapes are clamped to the
+// resulting range, so it is applied before they are added.
+func applyYRange(p *plot.Plot, expr PlotExpr, opts PlotOptions) int {
+	if opts.LogScale {
+		if opts.YMin != nil && *opts.YMin <= 0 {
+			clog.Warnf("Ignoring Y axis minimum %v on log scale", *opts.YMin)
+			opts.YMin = nil
+		}
+		if opts.YMax != nil && *opts.YMax <= 0 {
+			clog.Warnf("Ignoring Y axis maximum %v on log scale", *opts.YMax)
+			opts.YMax = nil
+		}
+	}
+	if opts.YMin != nil && opts.YMax != nil && *opts.YMin >= *opts.YMax {
+		clog.Warnf("Ignoring Y axis range %v to %v", *opts.YMin, *opts.YMax)
+		opts.YMin, opts.YMax = nil, nil
+	}
+
+	if opts.IncludeZero && !opts.LogScale {
+		p.Y.Min = math.Min(p.Y.Min, 0)
+		p.Y.Max = math.Max(p.Y.Max, 0)
+	}
+
+	if expr.HasThreshold() && (expr.Level > 0 || !opts.LogScale) {
+		// measure distances in decades on log scale
+		scale := func(v float64) float64 { return v }
+		if opts.LogScale {
+			scale = math.Log10
+		}
+		span := scale(p.Y.Max) - scale(p.Y.Min)
+		if span == 0 {
+			span = math.Max(math.Abs(scale(p.Y.Max)), 1)
+		}
+		distance := math.Max(scale(expr.Level)-scale(p.Y.Max), scale(p.Y.Min)-scale(expr.Level))
+
+		if distance <= viper.GetFloat64("threshold_max_distance")*span {
+			// pad the threshold side so the line doesn't sit on the border
+			padding := 0.05 * (span + math.Max(distance, 0))
+			if opts.YMin == nil && expr.Level <= p.Y.Min {
+				p.Y.Min = unscale(scale(expr.Level)-padding, opts.LogScale)
+			}
+			if opts.YMax == nil && expr.Level >= p.Y.Max {
+				p.Y.Max = unscale(scale(expr.Level)+padding, opts.LogScale)
+			}
+		} else {
+			clog.Infof("Threshold %v too far from data, drawing off-scale indicator", expr.Level)
+		}
+	}
+
+	if opts.YMin != nil && *opts.YMin < p.Y.Max {
+		p.Y.Min = *opts.YMin
+	} else if opts.YMin != nil {
+		clog.Warnf("Ignoring Y axis minimum %v above the data", *opts.YMin)
+	}
+	if opts.YMax != nil && *opts.YMax > p.Y.Min {
+		p.Y.Max = *opts.YMax
+	} else if opts.YMax != nil {
+		clog.Warnf("Ignoring Y axis maximum %v below the data", *opts.YMax)
+	}
+
+	if opts.LogScale {
+		p.Y.Scale = plot.LogScale{}
+		p.Y.Tick.Marker = unitTicks{Ticker: plot.LogTicks{Prec: -1}, Unit: expr.Unit}
+	}
+
+	switch {
+	case !expr.HasThreshold():
+		return 0
+	case expr.Level > p.Y.Max:
+		return 1
+	case expr.Level < p.Y.Min:
+		return -1
+	default:
+		return 0
+	}
+}
+
+func unscale(v float64, log bool) float64 {
+	if log {
+		return math.Pow(10, v)
+	}
+	return v
+}
+
+// drawThresholdLine draws the threshold of the alert as a dashed line.
+func drawThresholdLine(p *plot.Plot, expr PlotExpr) error {
+	line, err := plotter.NewLine(plotter.XYs{{X: p.X.Min, Y: expr.Level}, {X: p.X.Max, Y: expr.Level}})
+	if err != nil {
+		return errors.Wrap(err, "failed to create threshold line")
+	}
+	line.LineStyle.Width = vg.Points(1)
+	line.LineStyle.Color = thresholdColor(expr, 150)
+	line.LineStyle.Dashes = []vg.Length{vg.Points(4), vg.Points(2)}
+	p.Add(line)
+
+	return nil
+}
+
+// drawThresholdLabel writes the threshold value next to its line, or at the
+// edge of the graph with an arrow when the threshold is off-scale.
+func drawThresholdLabel(c draw.Canvas, p *plot.Plot, expr PlotExpr, offScale int, style draw.TextStyle) {
+	trX, trY := p.Transforms(&c)
+	name := "threshold"
+	if expr.Severity != "" {
+		name = expr.Severity
+		style.Color = thresholdColor(expr, 200)
+	}
+	text := fmt.Sprintf("%s %s %s", name, expr.Operator, FormatValue(expr.Level, expr.Unit))
+	x := trX(p.X.Min) + vg.Millimeter
+
+	switch offScale {
+	case 0:
+		style.YAlign = draw.YBottom
+		c.FillText(style, vg.Point{X: x, Y: trY(expr.Level) + vg.Millimeter/2}, text)
+		return
+	case 1:
+		style.YAlign = draw.YTop
+		y := c.Max.Y - vg.Millimeter
+		size := 1.5 * vg.Millimeter
+		c.FillPolygon(style.Color, []vg.Point{{X: x, Y: y - size}, {X: x + size, Y: y}, {X: x + 2*size, Y: y - size}})
+		c.FillText(style, vg.Point{X: x + 3*size, Y: y}, text)
+	case -1:
+		style.YAlign = draw.YBottom
+		y := c.Min.Y + vg.Millimeter
+		size := 1.5 * vg.Millimeter
+		c.FillPolygon(style.Color, []vg.Point{{X: x, Y: y + size}, {X: x + size, Y: y}, {X: x + 2*size, Y: y + size}})
+		c.FillText(style, vg.Point{X: x + 3*size, Y: y}, text)
+	}
+}
+
+// drawThresholdZone shades the area beyond the threshold of a < or > alert.
+func drawThresholdZone(p *plot.Plot, metrics model.Matrix, expr PlotExpr) error {
 	var polygonPoints plotter.XYs
 
-	if direction == "<" {
+	// keep the zone inside the axis range so it doesn't stretch the axis
+	level := math.Max(math.Min(expr.Level, p.Y.Max), p.Y.Min)
+	if expr.Operator == "<" {
 		polygonPoints = plotter.XYs{{X: p.X.Min, Y: level}, {X: p.X.Max, Y: level}, {X: p.X.Max, Y: p.Y.Min}, {X: p.X.Min, Y: p.Y.Min}}
 	} else {
 		polygonPoints = plotter.XYs{{X: p.X.Min, Y: level}, {X: p.X.Max, Y: level}, {X: p.X.Max, Y: p.Y.Max}, {X: p.X.Min, Y: p.Y.Max}}
@@ -226,46 +819,143 @@ func PlotMetric(metrics model.Matrix, level float64, direction string) (io.Write
 				"Metrics":       metrics,
 			},
 		})
-		return nil, polyErr
+		return polyErr
 	}
 	poly.Color = color.NRGBA{R: 255, A: 40}
 	poly.LineStyle.Color = color.NRGBA{R: 0, A: 0}
 	p.Add(poly)
-	p.Add(plotter.NewGrid())
 
-	// Draw plot in canvas with margin
-	margin := vg.Length(3*graphScale) * vg.Millimeter
-	width := vg.Length(12*graphScale) * vg.Centimeter
-	height := vg.Length(6*graphScale) * vg.Centimeter
-	c, err := draw.NewFormattedCanvas(width, height, "png")
+	return nil
+}
+
+// drawSeverityBands shades the area beyond each threshold of a < or > alert
+// in the colour of its severity, up to the threshold of the next severity,
+// and draws the threshold lines of the other severities.
+func drawSeverityBands(p *plot.Plot, expr PlotExpr) error {
+	thresholds := append([]PlotExpr{expr}, expr.Siblings...)
+	sort.Slice(thresholds, func(i, j int) bool {
+		if expr.Operator == "<" {
+			return thresholds[i].Level > thresholds[j].Level
+		}
+		return thresholds[i].Level < thresholds[j].Level
+	})
+
+	clamp := func(level float64) float64 { return math.Max(math.Min(level, p.Y.Max), p.Y.Min) }
+	for i, threshold := range thresholds {
+		end := p.Y.Max
+		if expr.Operator == "<" {
+			end = p.Y.Min
+		}
+		if i+1 < len(thresholds) {
+			end = thresholds[i+1].Level
+		}
+
+		level, end := clamp(threshold.Level), clamp(end)
+		if level != end {
+			band, err := plotter.NewPolygon(plotter.XYs{{X: p.X.Min, Y: level}, {X: p.X.Max, Y: level}, {X: p.X.Max, Y: end}, {X: p.X.Min, Y: end}})
+			if err != nil {
+				return errors.Wrap(err, "failed to create severity band")
+			}
+			band.Color = thresholdColor(threshold, 40)
+			band.LineStyle.Color = color.NRGBA{}
+			p.Add(band)
+		}
+
+		// the line of the alert threshold is drawn with the others
+		if threshold.Severity != expr.Severity && threshold.Level >= p.Y.Min && threshold.Level <= p.Y.Max {
+			if err := drawThresholdLine(p, threshold); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// thresholdColor returns the colour of the severity of a threshold, red for
+// thresholds without a known severity.
+func thresholdColor(expr PlotExpr, alpha uint8) color.NRGBA {
+	c := color.NRGBA{R: 255, A: alpha}
+	if hex := SeverityColor(expr.Severity); hex != "" {
+		if _, err := fmt.Sscanf(hex, "#%02x%02x%02x", &c.R, &c.G, &c.B); err != nil {
+			clog.Warnf("Invalid severity colour %s", hex)
+		}
+	}
+	return c
+}
+
+// drawViolations marks the samples that satisfy an == or != alert.
+func drawViolations(p *plot.Plot, violations plotter.XYs) error {
+	if len(violations) == 0 {
+		return nil
+	}
+
+	markers, err := plotter.NewScatter(violations)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to create canvas")
+		return errors.Wrap(err, "failed to create violation markers")
 	}
+	markers.GlyphStyle.Shape = draw.CrossGlyph{}
+	markers.GlyphStyle.Color = color.NRGBA{R: 255, A: 200}
+	markers.GlyphStyle.Radius = vg.Points(2)
+	p.Add(markers)
 
-	croppedCanvas := draw.Crop(draw.New(c), margin, -margin, margin, -margin)
-	p.Draw(croppedCanvas)
+	return nil
+}
 
-	// Draw last evaluated value
-	evalText := fmt.Sprintf("latest evaluation: %.2f", lastEvalValue)
+// drawGraphNotes writes short explanations of what is drawn in the bottom
+// left corner of the graph, stacked up from bottom.
+func drawGraphNotes(c draw.Canvas, notes []string, bottom vg.Length, style draw.TextStyle) {
+	y := bottom
+	for i := len(notes) - 1; i >= 0; i-- {
+		c.FillText(style, vg.Point{X: c.Min.X + vg.Millimeter, Y: y}, notes[i])
+		y += style.Height(notes[i]) + vg.Millimeter/2
+	}
+}
 
-	plotterCanvas := p.DataCanvas(croppedCanvas)
+// drawComparison draws each comparison series in the faded colour of the
+// series it belongs to.
+func drawComparison(p *plot.Plot, comparison, metrics model.Matrix, colors []color.Color, opts PlotOptions) error {
+	for _, sample := range comparison {
+		var lineColor color.NRGBA
+		for s, metric := range metrics {
+			if metric.Metric.Equal(sample.Metric) {
+				lineColor = color.NRGBAModel.Convert(colors[s%len(colors)]).(color.NRGBA)
+			}
+		}
+		lineColor.A = 100
 
-	trX, trY := p.Transforms(&plotterCanvas)
-	evalRectangle := evalTextStyle.Rectangle(evalText)
+		var segments []plotter.XYs
+		var data plotter.XYs
+		for _, v := range sample.Values {
+			f := float64(v.Value)
+			if math.IsNaN(f) || (opts.LogScale && f <= 0) {
+				segments = append(segments, data)
+				data = nil
+				continue
+			}
+			data = append(data, plotter.XY{X: float64(v.Timestamp.Unix()), Y: f})
+		}
+		segments = append(segments, data)
 
-	points := []vg.Point{
-		{X: trX(p.X.Max) + evalRectangle.Min.X - 8*vg.Millimeter, Y: trY(lastEvalValue) + evalRectangle.Min.Y - vg.Millimeter},
-		{X: trX(p.X.Max) + evalRectangle.Min.X - 8*vg.Millimeter, Y: trY(lastEvalValue) + evalRectangle.Max.Y + vg.Millimeter},
-		{X: trX(p.X.Max) + evalRectangle.Max.X - 6*vg.Millimeter, Y: trY(lastEvalValue) + evalRectangle.Max.Y + vg.Millimeter},
-		{X: trX(p.X.Max) + evalRectangle.Max.X - 6*vg.Millimeter, Y: trY(lastEvalValue) + evalRectangle.Min.Y - vg.Millimeter},
+		for _, segment := range segments {
+			if len(segment) == 0 {
+				continue
+			}
+			l, err := plotter.NewLine(segment)
+			if err != nil {
+				return errors.Wrap(err, "failed to create comparison line")
+			}
+			l.LineStyle.Width = vg.Points(1)
+			l.LineStyle.Color = lineColor
+			l.LineStyle.Dashes = []vg.Length{vg.Points(3), vg.Points(3)}
+			p.Add(l)
+		}
 	}
-	plotterCanvas.FillPolygon(color.NRGBA{R: 255, G: 255, B: 255, A: 90}, points)
-	plotterCanvas.FillText(evalTextStyle, vg.Point{X: trX(p.X.Max) - 6*vg.Millimeter, Y: trY(lastEvalValue)}, evalText)
 
-	return c, nil
+	return nil
 }
 
-func drawLine(data plotter.XYs, colors []color.Color, s int, paletteSize int, p *plot.Plot, metrics model.Matrix, sample *model.SampleStream) (*plotter.Line, error) {
+func drawLine(data plotter.XYs, colors []color.Color, s int, paletteSize int, p *plot.Plot, legend string) (*plotter.Line, error) {
 	var l *plotter.Line
 	var err error
 	if len(data) > 0 {
@@ -278,11 +968,8 @@ func drawLine(data plotter.XYs, colors []color.Color, s int, paletteSize int, p
 		l.LineStyle.Color = colors[s%paletteSize]
 
 		p.Add(l)
-		if len(metrics) > 1 {
-			m := labelText.FindStringSubmatch(sample.Metric.String())
-			if m != nil {
-				p.Legend.Add(m[1], l)
-			}
+		if legend != "" {
+			p.Legend.Add(legend, l)
 		}
 	}
 
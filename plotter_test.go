@@ -0,0 +1,141 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/spf13/viper"
+	"gonum.org/v1/plot/font"
+	"gonum.org/v1/plot/font/liberation"
+)
+
+func TestGetPlotExpr(t *testing.T) {
+	tests := []struct {
+		name    string
+		formula string
+		want    []PlotExpr
+		wantErr bool
+	}{
+		{name: "empty", formula: "", want: nil},
+		{name: "whitespace", formula: " \n", want: nil},
+		{name: "greater", formula: "rate(x[5m]) > 5", want: []PlotExpr{{Formula: "rate(x[5m])", Operator: ">", Level: 5}}},
+		{name: "greater or equal", formula: "x >= 5", want: []PlotExpr{{Formula: "x", Operator: ">", Level: 5}}},
+		{name: "less", formula: "x < 5", want: []PlotExpr{{Formula: "x", Operator: "<", Level: 5}}},
+		{name: "equal", formula: "up == 0", want: []PlotExpr{{Formula: "up", Operator: "==", Level: 0}}},
+		{name: "not equal", formula: "up != 1", want: []PlotExpr{{Formula: "up", Operator: "!=", Level: 1}}},
+		{name: "scalar on the left", formula: "5 < x", want: []PlotExpr{{Formula: "x", Operator: ">", Level: 5}}},
+		{name: "constant expression", formula: "x > (0.5 * 100)", want: []PlotExpr{{Formula: "x", Operator: ">", Level: 50}}},
+		{name: "negative", formula: "x < -1", want: []PlotExpr{{Formula: "x", Operator: "<", Level: -1}}},
+		{name: "parens", formula: "((x) > 5)", want: []PlotExpr{{Formula: "x", Operator: ">", Level: 5}}},
+		{
+			name:    "and",
+			formula: "x > 5 and y < 3",
+			want:    []PlotExpr{{Formula: "x", Operator: ">", Level: 5}, {Formula: "y", Operator: "<", Level: 3}},
+		},
+		{
+			name:    "or",
+			formula: "x > 5 or y < 3",
+			want:    []PlotExpr{{Formula: "x", Operator: ">", Level: 5}, {Formula: "y", Operator: "<", Level: 3}},
+		},
+		{name: "unless", formula: "x > 5 unless y", want: []PlotExpr{{Formula: "x", Operator: ">", Level: 5}}},
+		{name: "bool", formula: "(x > bool 5) == 1", want: []PlotExpr{{Formula: "x", Operator: ">", Level: 5}}},
+		{
+			name:    "nested comparison",
+			formula: "count(x > 5) > 3",
+			want:    []PlotExpr{{Formula: "count(x > 5)", Operator: ">", Level: 3}, {Formula: "x", Operator: ">", Level: 5}},
+		},
+		{name: "max above", formula: "max(x > 5)", want: []PlotExpr{{Formula: "max(x)", Operator: ">", Level: 5}}},
+		{name: "min above", formula: "min(x > 5)", want: []PlotExpr{{Formula: "max(x)", Operator: ">", Level: 5}}},
+		{name: "max below", formula: "max(x < 5)", want: []PlotExpr{{Formula: "min(x)", Operator: "<", Level: 5}}},
+		{name: "min below", formula: "min by (job) (x < 5)", want: []PlotExpr{{Formula: "min by (job) (x)", Operator: "<", Level: 5}}},
+		{name: "topk below", formula: "topk(3, x < 5)", want: []PlotExpr{{Formula: "bottomk(3, x)", Operator: "<", Level: 5}}},
+		{name: "bottomk above", formula: "bottomk(3, 5 < x)", want: []PlotExpr{{Formula: "topk(3, x)", Operator: ">", Level: 5}}},
+		{
+			name:    "max equal",
+			formula: "max(x == 1)",
+			want:    []PlotExpr{{Formula: "max(x == 1)"}, {Formula: "x", Operator: "==", Level: 1}},
+		},
+		{name: "two vectors", formula: "x > y", want: []PlotExpr{{Formula: "x"}, {Formula: "y"}}},
+		{name: "no comparison", formula: "sum(rate(x[5m]))", want: []PlotExpr{{Formula: "sum(rate(x[5m]))"}}},
+		{name: "unparseable", formula: "x >", want: []PlotExpr{{Formula: "x >"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := GetPlotExpr(tt.formula)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetPlotExpr(%q) error = %v, wantErr %v", tt.formula, err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("GetPlotExpr(%q) = %v, want %v", tt.formula, got, tt.want)
+			}
+			for i := range got {
+				if got[i].Formula != tt.want[i].Formula || got[i].Operator != tt.want[i].Operator || got[i].Level != tt.want[i].Level {
+					t.Errorf("GetPlotExpr(%q)[%d] = %v, want %v", tt.formula, i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestHasPositiveValues(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []model.SampleValue
+		want   bool
+	}{
+		{name: "positive", values: []model.SampleValue{-1, 0, 0.5}, want: true},
+		{name: "zero and negative", values: []model.SampleValue{-1, 0}, want: false},
+		{name: "empty", values: nil, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := &model.SampleStream{}
+			for i, v := range tt.values {
+				stream.Values = append(stream.Values, model.SamplePair{Timestamp: model.Time(i * 1000), Value: v})
+			}
+			if got := hasPositiveValues(model.Matrix{stream}); got != tt.want {
+				t.Errorf("hasPositiveValues(%v) = %v, want %v", tt.values, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlotMetricYRange(t *testing.T) {
+	font.DefaultCache.Add(liberation.Collection())
+	viper.Set("graph_scale", 1.0)
+	viper.Set("threshold_max_distance", 3.0)
+
+	series := func(values ...model.SampleValue) model.Matrix {
+		stream := &model.SampleStream{Metric: model.Metric{"job": "api"}}
+		for i, v := range values {
+			stream.Values = append(stream.Values, model.SamplePair{Timestamp: model.Time(i * 60000), Value: v})
+		}
+		return model.Matrix{stream}
+	}
+	value := func(v float64) *float64 { return &v }
+
+	tests := []struct {
+		name    string
+		metrics model.Matrix
+		opts    PlotOptions
+	}{
+		{name: "log scale", metrics: series(0.1, 1, 10), opts: PlotOptions{LogScale: true}},
+		{name: "log scale without positive values", metrics: series(-1, 0, -3), opts: PlotOptions{LogScale: true}},
+		{name: "log scale with negative maximum", metrics: series(1, 0, 3), opts: PlotOptions{LogScale: true, YMax: value(-1)}},
+		{name: "log scale with zero minimum", metrics: series(1, 0, 3), opts: PlotOptions{LogScale: true, YMin: value(0)}},
+		{name: "minimum above maximum", metrics: series(1, 0, 3), opts: PlotOptions{YMin: value(5), YMax: value(2)}},
+		{name: "minimum above the data", metrics: series(1, 0, 3), opts: PlotOptions{YMin: value(5)}},
+		{name: "maximum below the data", metrics: series(1, 0, 3), opts: PlotOptions{YMax: value(-5)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expr := PlotExpr{Formula: "x", Operator: ">", Level: 2}
+			if _, err := PlotMetric(PlotData{Metrics: tt.metrics}, expr, tt.opts); err != nil {
+				t.Errorf("PlotMetric() error = %v", err)
+			}
+		})
+	}
+}
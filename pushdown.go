@@ -0,0 +1,183 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/spf13/viper"
+)
+
+// InjectLabels adds the alert labels as matchers to the selectors of a
+// formula, so Prometheus only returns the series behind the alert. A label
+// is only pushed into a selector when every series contributing to a
+// result carrying that label must carry it too, e.g. it survives the
+// aggregations and vector matching on the way up. It reports false when no
+// matcher was added.
+func InjectLabels(formula string, alertLabels KV) (string, bool, error) {
+	expr, err := parser.ParseExpr(formula)
+	if err != nil {
+		return formula, false, errors.Wrap(err, "failed to parse formula")
+	}
+
+	excluded := make(map[string]bool)
+	for _, name := range viper.GetStringSlice("label_pushdown_exclude") {
+		excluded[name] = true
+	}
+
+	set := make(map[string]string, len(alertLabels))
+	for name, value := range alertLabels {
+		if excluded[name] || strings.HasPrefix(name, "__") {
+			continue
+		}
+		set[name] = value
+	}
+
+	if !injectLabels(expr, set) {
+		return formula, false, nil
+	}
+
+	return expr.String(), true, nil
+}
+
+func injectLabels(node parser.Node, set map[string]string) bool {
+	if len(set) == 0 {
+		return false
+	}
+
+	switch n := node.(type) {
+	case *parser.VectorSelector:
+		constrained := make(map[string]bool, len(n.LabelMatchers))
+		for _, matcher := range n.LabelMatchers {
+			constrained[matcher.Name] = true
+		}
+		names := make([]string, 0, len(set))
+		for name := range set {
+			if !constrained[name] {
+				names = append(names, name)
+			}
+		}
+		// sorted to keep the query stable across notifications
+		sort.Strings(names)
+		for _, name := range names {
+			n.LabelMatchers = append(n.LabelMatchers, labels.MustNewMatcher(labels.MatchEqual, name, set[name]))
+		}
+		return len(names) > 0
+
+	case *parser.MatrixSelector:
+		return injectLabels(n.VectorSelector, set)
+	case *parser.SubqueryExpr:
+		return injectLabels(n.Expr, set)
+	case *parser.ParenExpr:
+		return injectLabels(n.Expr, set)
+	case *parser.StepInvariantExpr:
+		return injectLabels(n.Expr, set)
+	case *parser.UnaryExpr:
+		return injectLabels(n.Expr, set)
+
+	case *parser.AggregateExpr:
+		if n.Op == parser.COUNT_VALUES {
+			if param, ok := n.Param.(*parser.StringLiteral); ok {
+				set = withoutLabels(set, []string{param.Val})
+			}
+		}
+		if n.Without {
+			set = withoutLabels(set, n.Grouping)
+		} else {
+			set = onlyLabels(set, n.Grouping)
+		}
+		return injectLabels(n.Expr, set)
+
+	case *parser.BinaryExpr:
+		lhsScalar := n.LHS.Type() == parser.ValueTypeScalar
+		rhsScalar := n.RHS.Type() == parser.ValueTypeScalar
+		switch {
+		case lhsScalar && rhsScalar:
+			return false
+		case rhsScalar:
+			return injectLabels(n.LHS, set)
+		case lhsScalar:
+			return injectLabels(n.RHS, set)
+		}
+
+		if n.VectorMatching == nil {
+			return false
+		}
+
+		// labels the other side must agree on to match
+		matched := withoutLabels(set, n.VectorMatching.MatchingLabels)
+		if n.VectorMatching.On {
+			matched = onlyLabels(set, n.VectorMatching.MatchingLabels)
+		}
+
+		lhs, rhs := set, matched
+		switch {
+		case n.Op == parser.LOR:
+			// results come from either side
+			lhs = matched
+		case n.VectorMatching.Card == parser.CardManyToOne:
+			lhs = withoutLabels(set, n.VectorMatching.Include)
+			rhs = mergeLabels(matched, onlyLabels(set, n.VectorMatching.Include))
+		case n.VectorMatching.Card == parser.CardOneToMany:
+			lhs = mergeLabels(matched, onlyLabels(set, n.VectorMatching.Include))
+			rhs = withoutLabels(set, n.VectorMatching.Include)
+		}
+
+		injectedLHS := injectLabels(n.LHS, lhs)
+		injectedRHS := injectLabels(n.RHS, rhs)
+		return injectedLHS || injectedRHS
+
+	case *parser.Call:
+		switch n.Func.Name {
+		case "absent", "absent_over_time", "scalar", "vector", "time", "info":
+			// results don't carry the labels of their arguments
+			return false
+		case "label_replace", "label_join":
+			if dst, ok := n.Args[1].(*parser.StringLiteral); ok {
+				set = withoutLabels(set, []string{dst.Val})
+			}
+			return injectLabels(n.Args[0], set)
+		}
+
+		injected := false
+		for _, arg := range n.Args {
+			if arg.Type() == parser.ValueTypeVector || arg.Type() == parser.ValueTypeMatrix {
+				injected = injectLabels(arg, set) || injected
+			}
+		}
+		return injected
+	}
+
+	return false
+}
+
+func onlyLabels(set map[string]string, names []string) map[string]string {
+	result := make(map[string]string)
+	for _, name := range names {
+		if value, ok := set[name]; ok {
+			result[name] = value
+		}
+	}
+	return result
+}
+
+func withoutLabels(set map[string]string, names []string) map[string]string {
+	result := make(map[string]string, len(set))
+	for name, value := range set {
+		result[name] = value
+	}
+	for _, name := range names {
+		delete(result, name)
+	}
+	return result
+}
+
+func mergeLabels(a, b map[string]string) map[string]string {
+	result := withoutLabels(a, nil)
+	for name, value := range b {
+		result[name] = value
+	}
+	return result
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestInjectLabels(t *testing.T) {
+	viper.Set("label_pushdown_exclude", []string{"alertname", "severity"})
+	labels := KV{"alertname": "HighErrors", "severity": "warn", "job": "api", "instance": "i1"}
+
+	tests := []struct {
+		name    string
+		formula string
+		want    string
+		wantOK  bool
+		wantErr bool
+	}{
+		{
+			name:    "selector",
+			formula: "up == 0",
+			want:    `up{instance="i1",job="api"} == 0`,
+			wantOK:  true,
+		},
+		{
+			name:    "constrained label",
+			formula: `x{job="other"} > 1`,
+			want:    `x{instance="i1",job="other"} > 1`,
+			wantOK:  true,
+		},
+		{
+			name:    "aggregation by",
+			formula: "sum by (job) (rate(x[5m])) > 1",
+			want:    `sum by (job) (rate(x{job="api"}[5m])) > 1`,
+			wantOK:  true,
+		},
+		{
+			name:    "aggregation without",
+			formula: "sum without (instance) (x) > 1",
+			want:    `sum without (instance) (x{job="api"}) > 1`,
+			wantOK:  true,
+		},
+		{
+			name:    "aggregation of everything",
+			formula: "sum(rate(x[5m])) > 1",
+			want:    "sum(rate(x[5m])) > 1",
+		},
+		{
+			name:    "vector matching on",
+			formula: "x / on (job) y > 1",
+			want:    `x{instance="i1",job="api"} / on (job) y{job="api"} > 1`,
+			wantOK:  true,
+		},
+		{
+			name:    "label replaced",
+			formula: `label_replace(x, "instance", "$1", "host", "(.*)") > 1`,
+			want:    `label_replace(x{job="api"}, "instance", "$1", "host", "(.*)") > 1`,
+			wantOK:  true,
+		},
+		{
+			name:    "absent",
+			formula: `absent(up{job="api"})`,
+			want:    `absent(up{job="api"})`,
+		},
+		{
+			name:    "unparseable",
+			formula: "x >",
+			want:    "x >",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok, err := InjectLabels(tt.formula, labels)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("InjectLabels(%q) error = %v, wantErr %v", tt.formula, err, tt.wantErr)
+			}
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("InjectLabels(%q) = %q, %v, want %q, %v", tt.formula, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
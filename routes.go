@@ -0,0 +1,209 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bugsnag/bugsnag-go/v2"
+	"github.com/bugsnag/microkit/clog"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/spf13/viper"
+)
+
+// RouteConfig holds per-receiver settings from the `routes` config section,
+// keyed by Alertmanager receiver name.
+type RouteConfig struct {
+	Plot   PlotOptions `mapstructure:"plot"`
+	Window PlotWindow  `mapstructure:"window"`
+	// Datasource is the name of the datasource queried for alerts that
+	// don't match one otherwise
+	Datasource string `mapstructure:"datasource"`
+	// LogQL is the Loki query for log excerpts of alerts without a logql
+	// annotation, with $label placeholders
+	LogQL string `mapstructure:"logql"`
+}
+
+// PlotWindow is the policy for the time range graphed around an alert:
+// LeadIn before it started, Tail after it resolved, bounded by Min and Max.
+type PlotWindow struct {
+	LeadIn time.Duration `mapstructure:"lead_in"`
+	Tail   time.Duration `mapstructure:"tail"`
+	Min    time.Duration `mapstructure:"min"`
+	Max    time.Duration `mapstructure:"max"`
+}
+
+// GetPlotWindow returns the `plot_window` config, with any fields set in
+// the route of the receiver taking precedence.
+func GetPlotWindow(receiver string) PlotWindow {
+	window := PlotWindow{
+		LeadIn: time.Minute * 15,
+		Tail:   time.Minute * 5,
+		Min:    time.Minute * 20,
+		Max:    time.Hour * 24,
+	}
+	if err := viper.UnmarshalKey("plot_window", &window); err != nil {
+		err = errors.Wrap(err, "Could not parse plot window config")
+		_ = bugsnag.Notify(err)
+		clog.Error(err.Error())
+	}
+
+	route := GetRouteConfig(receiver).Window
+	if route.LeadIn != 0 {
+		window.LeadIn = route.LeadIn
+	}
+	if route.Tail != 0 {
+		window.Tail = route.Tail
+	}
+	if route.Min != 0 {
+		window.Min = route.Min
+	}
+	if route.Max != 0 {
+		window.Max = route.Max
+	}
+
+	return window
+}
+
+// PlotOptions control how graphs are drawn. Route defaults are overridden
+// by alert annotations.
+type PlotOptions struct {
+	LogScale    bool     `mapstructure:"log_scale"`
+	YMin        *float64 `mapstructure:"y_min"`
+	YMax        *float64 `mapstructure:"y_max"`
+	IncludeZero bool     `mapstructure:"include_zero"`
+	// Heatmap shades the bucket distribution behind histogram_quantile graphs
+	Heatmap bool `mapstructure:"heatmap"`
+	// Composite draws all expressions of an alert as panels of one image
+	Composite bool `mapstructure:"composite"`
+	// CompareOffset overlays the same formula this long ago, e.g. 1d or 1w
+	CompareOffset string `mapstructure:"compare_offset"`
+	// Series is the series selection strategy, see SelectSeries
+	Series      string `mapstructure:"series"`
+	SeriesLimit int    `mapstructure:"series_limit"`
+	// SeriesRank orders series for the top strategy, by "peak" or "last" value
+	SeriesRank string `mapstructure:"series_rank"`
+	// Lookback overrides the minimum time range graphed, e.g. 1h
+	Lookback string `mapstructure:"lookback"`
+	Disabled bool   `mapstructure:"disabled"`
+	// Legend is a template for legend entries, e.g. "$instance ${code}"
+	Legend string `mapstructure:"legend"`
+	// Title is a template for the graph title, expanded with alert labels
+	Title string `mapstructure:"title"`
+	// Expr replaces the alert expression, it only makes sense per alert so
+	// is read from annotations alone
+	Expr string `mapstructure:"-"`
+}
+
+// LookbackDuration parses Lookback, reporting false when it isn't set.
+func (opts PlotOptions) LookbackDuration() (time.Duration, bool) {
+	if opts.Lookback == "" {
+		return 0, false
+	}
+
+	lookback, err := model.ParseDuration(opts.Lookback)
+	if err != nil || lookback <= 0 {
+		clog.Warnf("Ignoring lookback, not a positive duration: %s", opts.Lookback)
+		return 0, false
+	}
+	return time.Duration(lookback), true
+}
+
+// CompareDuration parses CompareOffset, reporting false when no
+// comparison should be drawn.
+func (opts PlotOptions) CompareDuration() (time.Duration, bool) {
+	if opts.CompareOffset == "" {
+		return 0, false
+	}
+
+	offset, err := model.ParseDuration(opts.CompareOffset)
+	if err != nil || offset <= 0 {
+		clog.Warnf("Ignoring comparison offset, not a positive duration: %s", opts.CompareOffset)
+		return 0, false
+	}
+	return time.Duration(offset), true
+}
+
+// GetRouteConfig returns the settings for an Alertmanager receiver. Viper
+// lowercases map keys, so receivers are matched case-insensitively.
+func GetRouteConfig(receiver string) RouteConfig {
+	var routes map[string]RouteConfig
+	if err := viper.UnmarshalKey("routes", &routes); err != nil {
+		err = errors.Wrap(err, "Could not parse routes config")
+		_ = bugsnag.Notify(err)
+		clog.Error(err.Error())
+	}
+
+	return routes[strings.ToLower(receiver)]
+}
+
+// PlotOptions merges the route defaults of the alert's receiver with the
+// plot_* annotations of the alert rule.
+func (alert Alert) PlotOptions() PlotOptions {
+	opts := GetRouteConfig(alert.Receiver).Plot
+
+	alert.boolAnnotation("plot_log_scale", &opts.LogScale)
+	alert.boolAnnotation("plot_include_zero", &opts.IncludeZero)
+	alert.boolAnnotation("plot_disabled", &opts.Disabled)
+	alert.boolAnnotation("plot_heatmap", &opts.Heatmap)
+	alert.boolAnnotation("plot_composite", &opts.Composite)
+	if v, ok := alert.floatAnnotation("plot_y_min"); ok {
+		opts.YMin = &v
+	}
+	if v, ok := alert.floatAnnotation("plot_y_max"); ok {
+		opts.YMax = &v
+	}
+	if v, ok := alert.Annotations["plot_compare_offset"]; ok {
+		opts.CompareOffset = v
+	}
+	if v, ok := alert.Annotations["plot_series"]; ok {
+		opts.Series = v
+	}
+	if v, ok := alert.floatAnnotation("plot_series_limit"); ok {
+		opts.SeriesLimit = int(v)
+	}
+	if v, ok := alert.Annotations["plot_series_rank"]; ok {
+		opts.SeriesRank = v
+	}
+	if v, ok := alert.Annotations["plot_lookback"]; ok {
+		opts.Lookback = v
+	}
+	if v, ok := alert.Annotations["plot_legend"]; ok {
+		opts.Legend = v
+	}
+	if v, ok := alert.Annotations["plot_title"]; ok {
+		opts.Title = v
+	}
+	opts.Expr = alert.Annotations["plot_expr"]
+
+	return opts
+}
+
+func (alert Alert) boolAnnotation(name string, target *bool) {
+	value, ok := alert.Annotations[name]
+	if !ok {
+		return
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		clog.Warnf("Ignoring annotation %s, not a boolean: %s", name, value)
+		return
+	}
+	*target = b
+}
+
+func (alert Alert) floatAnnotation(name string) (float64, bool) {
+	value, ok := alert.Annotations[name]
+	if !ok {
+		return 0, false
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		clog.Warnf("Ignoring annotation %s, not a number: %s", name, value)
+		return 0, false
+	}
+	return f, true
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bugsnag/bugsnag-go/v2"
+	"github.com/bugsnag/microkit/clog"
+	"github.com/pkg/errors"
+	prometheusApi "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/spf13/viper"
+)
+
+// AlertRule is the alerting rule behind an alert, from the rules API.
+type AlertRule struct {
+	Name string
+	Expr string
+	// For is how long the expression was true before the alert fired
+	For    time.Duration
+	Group  string
+	File   string
+	Labels KV
+	// Severity is the severity label of the rule, as expanded on its active
+	// alerts when the label is templated
+	Severity string
+	// Siblings are the rules of the same name at other severities
+	Siblings []AlertRule
+}
+
+// Rule groups are kept for `rules_cache_ttl` per datasource, as every alert
+// of a webhook looks its rule up.
+var ruleGroups = struct {
+	sync.Mutex
+	groups map[string]cachedRuleGroups
+}{groups: make(map[string]cachedRuleGroups)}
+
+type cachedRuleGroups struct {
+	groups  []prometheusApi.RuleGroup
+	fetched time.Time
+}
+
+// RuleGroups fetches the rule groups of a datasource.
+func RuleGroups(ctx context.Context, datasource Datasource) ([]prometheusApi.RuleGroup, error) {
+	key, err := json.Marshal(datasource)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to identify datasource")
+	}
+
+	ruleGroups.Lock()
+	cached, ok := ruleGroups.groups[string(key)]
+	ruleGroups.Unlock()
+	if ok && time.Since(cached.fetched) < viper.GetDuration("rules_cache_ttl") {
+		return cached.groups, nil
+	}
+
+	api, err := datasourceAPI(datasource)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules prometheusApi.RulesResult
+	err = withRetries(ctx, datasource, "rules", func(ctx context.Context) (err error) {
+		rules, err = api.Rules(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ruleGroups.Lock()
+	ruleGroups.groups[string(key)] = cachedRuleGroups{groups: rules.Groups, fetched: time.Now()}
+	ruleGroups.Unlock()
+
+	return rules.Groups, nil
+}
+
+// LookupRule finds the rule of the alert on its datasource, or returns nil.
+// The rule of the alertname with an active alert that has the labels of the
+// alert is preferred, since rules only differing by templated labels can't
+// be told apart otherwise. Else the first rule whose static labels the alert
+// carries is used.
+func (alert Alert) LookupRule(ctx context.Context) *AlertRule {
+	if !viper.GetBool("rules_lookup") {
+		return nil
+	}
+
+	groups, err := RuleGroups(ctx, alert.Datasource)
+	if err != nil {
+		err = errors.Wrap(err, "Rules API error")
+		if !rulesAPIUnsupported(err) {
+			_ = bugsnag.Notify(err,
+				bugsnag.MetaData{
+					"Alert": {
+						"Name":       alert.Labels["alertname"],
+						"Datasource": alert.Datasource.Name,
+					},
+				})
+		}
+		clog.Warn(err.Error())
+		return nil
+	}
+
+	var named []AlertRule
+	active, static := -1, -1
+	for _, group := range groups {
+		for _, rule := range group.Rules {
+			r, ok := rule.(prometheusApi.AlertingRule)
+			if !ok || r.Name != alert.Labels["alertname"] {
+				continue
+			}
+
+			named = append(named, AlertRule{
+				Name:     r.Name,
+				Expr:     r.Query,
+				For:      time.Duration(r.Duration * float64(time.Second)),
+				Group:    group.Name,
+				File:     group.File,
+				Labels:   labelSetKV(r.Labels),
+				Severity: alert.ruleSeverity(r),
+			})
+			for _, a := range r.Alerts {
+				if active < 0 && alert.hasLabels(a.Labels) {
+					active = len(named) - 1
+				}
+			}
+			if static < 0 && alert.hasLabels(r.Labels) {
+				static = len(named) - 1
+			}
+		}
+	}
+
+	found := active
+	if found < 0 {
+		found = static
+	}
+	if found < 0 {
+		clog.Infof("No rule found for alert %s", alert.Labels["alertname"])
+		return nil
+	}
+
+	rule := named[found]
+	for _, sibling := range named {
+		// templated severities of rules without active alerts aren't known
+		if sibling.Severity != "" && !strings.Contains(sibling.Severity, "{{") && sibling.Severity != rule.Severity {
+			rule.Siblings = append(rule.Siblings, sibling)
+		}
+	}
+
+	clog.Infof("Found rule %s in group %s with %d siblings", rule.Name, rule.Group, len(rule.Siblings))
+	return &rule
+}
+
+// rulesAPIUnsupported tells errors of datasources without a rules API, such
+// as a 404 from a query frontend, which aren't worth reporting per alert.
+func rulesAPIUnsupported(err error) bool {
+	var apiErr *prometheusApi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.Type == prometheusApi.ErrClient || apiErr.Type == prometheusApi.ErrBadData
+}
+
+// ruleSeverity returns the severity label of a rule. Templated labels are
+// only expanded on the active alerts of the rule, so theirs is taken when
+// there are any, preferably from the one sharing the labels of the alert.
+func (alert Alert) ruleSeverity(r prometheusApi.AlertingRule) string {
+	var first string
+	for _, a := range r.Alerts {
+		severity := string(a.Labels["severity"])
+		if severity == "" {
+			continue
+		}
+		labels := a.Labels.Clone()
+		delete(labels, "severity")
+		if alert.hasLabels(labels) {
+			return severity
+		}
+		if first == "" {
+			first = severity
+		}
+	}
+	if first != "" {
+		return first
+	}
+	return string(r.Labels["severity"])
+}
+
+func (alert Alert) hasLabels(labels model.LabelSet) bool {
+	for name, value := range labels {
+		if alert.Labels[string(name)] != string(value) {
+			return false
+		}
+	}
+	return true
+}
+
+func labelSetKV(labels model.LabelSet) KV {
+	kv := make(KV, len(labels))
+	for name, value := range labels {
+		kv[string(name)] = string(value)
+	}
+	return kv
+}
+
+// SiblingThresholds returns the thresholds of the rules of the same name at
+// other severities, by the formula they apply to. Siblings are taken from
+// `sibling_rules` when the alert is listed there, else from the rules API.
+func (alert Alert) SiblingThresholds() map[string][]PlotExpr {
+	severity := alert.Labels["severity"]
+	exprs := make(map[string]string)
+
+	var configured map[string]map[string]string
+	if err := viper.UnmarshalKey("sibling_rules", &configured); err != nil {
+		err = errors.Wrap(err, "Could not parse sibling rules config")
+		_ = bugsnag.Notify(err)
+		clog.Error(err.Error())
+	}
+	// viper lowercases map keys
+	if rules, ok := configured[strings.ToLower(alert.Labels["alertname"])]; ok {
+		for ruleSeverity, expr := range rules {
+			if ruleSeverity != strings.ToLower(severity) {
+				exprs[ruleSeverity] = expr
+			}
+		}
+	} else if alert.Rule != nil {
+		for _, sibling := range alert.Rule.Siblings {
+			exprs[sibling.Severity] = sibling.Expr
+		}
+	}
+
+	thresholds := make(map[string][]PlotExpr)
+	for ruleSeverity, expr := range exprs {
+		plotExprs, err := GetPlotExpr(expr)
+		if err != nil {
+			clog.Warnf("Ignoring %s sibling rule: %s", ruleSeverity, err.Error())
+			continue
+		}
+		for _, plotExpr := range plotExprs {
+			if plotExpr.HasThreshold() {
+				plotExpr.Severity = ruleSeverity
+				thresholds[plotExpr.Formula] = append(thresholds[plotExpr.Formula], plotExpr)
+			}
+		}
+	}
+
+	return thresholds
+}
+
+// withSiblingThresholds adds the thresholds of sibling rules on the same
+// side of the formula as the threshold of the alert.
+func (alert Alert) withSiblingThresholds(expr PlotExpr, siblings map[string][]PlotExpr) PlotExpr {
+	if expr.Operator != "<" && expr.Operator != ">" {
+		return expr
+	}
+
+	for _, sibling := range siblings[expr.Formula] {
+		if sibling.Operator == expr.Operator {
+			sibling.Unit = expr.Unit
+			expr.Siblings = append(expr.Siblings, sibling)
+		}
+	}
+	if len(expr.Siblings) > 0 {
+		expr.Severity = alert.Labels["severity"]
+	}
+
+	return expr
+}
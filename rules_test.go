@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Three rules of the same name, told apart by a templated severity label
+// that is only expanded on their active alerts.
+const rulesResponse = `{
+  "status": "success",
+  "data": {
+    "groups": [
+      {
+        "name": "api",
+        "file": "api.yml",
+        "rules": [
+          {
+            "type": "alerting",
+            "name": "HighLatency",
+            "query": "latency > 1",
+            "duration": 300,
+            "labels": {"severity": "{{ $labels.tier }}-warn"},
+            "alerts": [
+              {"labels": {"alertname": "HighLatency", "severity": "db-warn", "instance": "b", "tier": "db"}},
+              {"labels": {"alertname": "HighLatency", "severity": "web-warn", "instance": "a", "tier": "web"}}
+            ]
+          },
+          {
+            "type": "alerting",
+            "name": "HighLatency",
+            "query": "latency > 5",
+            "duration": 60,
+            "labels": {"severity": "{{ $labels.tier }}-critical"},
+            "alerts": [{"labels": {"alertname": "HighLatency", "severity": "web-critical", "instance": "a", "tier": "web"}}]
+          },
+          {
+            "type": "alerting",
+            "name": "HighLatency",
+            "query": "latency > 10",
+            "duration": 0,
+            "labels": {"severity": "{{ $labels.tier }}-page"},
+            "alerts": []
+          },
+          {
+            "type": "alerting",
+            "name": "Down",
+            "query": "up == 0",
+            "duration": 0,
+            "labels": {"severity": "page"},
+            "alerts": []
+          }
+        ]
+      }
+    ]
+  }
+}`
+
+func TestLookupRule(t *testing.T) {
+	viper.Set("rules_lookup", true)
+	viper.Set("query_timeout", time.Second)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/rules" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(rulesResponse))
+	}))
+	defer srv.Close()
+	datasource := Datasource{Name: "rules", URL: srv.URL}
+
+	tests := []struct {
+		name     string
+		labels   KV
+		wantExpr string
+	}{
+		{
+			name:     "active alert",
+			labels:   KV{"alertname": "HighLatency", "severity": "web-critical", "instance": "a", "tier": "web"},
+			wantExpr: "latency > 5",
+		},
+		{
+			name:     "static labels",
+			labels:   KV{"alertname": "Down", "severity": "page", "job": "api"},
+			wantExpr: "up == 0",
+		},
+		{
+			name:   "other severity",
+			labels: KV{"alertname": "Down", "severity": "warn"},
+		},
+		{
+			name:   "unknown",
+			labels: KV{"alertname": "Unknown"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := Alert{Labels: tt.labels, Datasource: datasource}.LookupRule(context.Background())
+			switch {
+			case tt.wantExpr == "" && rule != nil:
+				t.Errorf("LookupRule() = %s, want none", rule.Expr)
+			case tt.wantExpr != "" && rule == nil:
+				t.Errorf("LookupRule() = none, want %s", tt.wantExpr)
+			case rule != nil && rule.Expr != tt.wantExpr:
+				t.Errorf("LookupRule() = %s, want %s", rule.Expr, tt.wantExpr)
+			}
+		})
+	}
+}
+
+func TestSiblingThresholds(t *testing.T) {
+	viper.Set("rules_lookup", true)
+	viper.Set("query_timeout", time.Second)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(rulesResponse))
+	}))
+	defer srv.Close()
+
+	alert := Alert{
+		Labels:     KV{"alertname": "HighLatency", "severity": "web-critical", "instance": "a", "tier": "web"},
+		Datasource: Datasource{Name: "siblings", URL: srv.URL},
+	}
+	alert.Rule = alert.LookupRule(context.Background())
+	if alert.Rule == nil {
+		t.Fatal("LookupRule() = none")
+	}
+	if alert.Rule.Severity != "web-critical" {
+		t.Errorf("LookupRule().Severity = %s, want web-critical", alert.Rule.Severity)
+	}
+
+	// the page rule has no active alert to tell its severity
+	thresholds := alert.SiblingThresholds()
+	if len(thresholds) != 1 || len(thresholds["latency"]) != 1 {
+		t.Fatalf("SiblingThresholds() = %v, want one threshold of latency", thresholds)
+	}
+	if got := thresholds["latency"][0]; got.Severity != "web-warn" || got.Level != 1 {
+		t.Errorf("SiblingThresholds() = %s at %v, want web-warn at 1", got.Severity, got.Level)
+	}
+}
+
+func TestRulesAPIUnsupported(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   bool
+	}{
+		{name: "not found", status: http.StatusNotFound, body: "404 page not found", want: true},
+		{name: "bad data", status: http.StatusBadRequest, body: `{"status": "error", "errorType": "bad_data", "error": "unknown"}`, want: true},
+		{name: "server error", status: http.StatusBadGateway, body: "bad gateway", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			viper.Set("query_timeout", time.Second)
+			viper.Set("query_retries", 0)
+			_, err := RuleGroups(context.Background(), Datasource{Name: tt.name, URL: srv.URL})
+			if err == nil {
+				t.Fatal("RuleGroups() error = nil")
+			}
+			if got := rulesAPIUnsupported(err); got != tt.want {
+				t.Errorf("rulesAPIUnsupported(%v) = %v, want %v", err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/bugsnag/microkit/clog"
+	"github.com/prometheus/common/model"
+	"github.com/spf13/viper"
+)
+
+// Series selection strategies
+const (
+	SeriesAuto     = "auto"
+	SeriesMatch    = "match"
+	SeriesAll      = "all"
+	SeriesTop      = "top"
+	SeriesEnvelope = "envelope"
+)
+
+// SelectSeries picks the series to draw and describes the choice, which is
+// noted on the graph. The auto strategy uses the series matching
+// the alert labels, and otherwise falls back to all series, the top series
+// or an envelope as the number of series grows.
+func SelectSeries(metrics model.Matrix, alert Alert, opts PlotOptions) (model.Matrix, string) {
+	limit := opts.SeriesLimit
+	if limit <= 0 {
+		limit = viper.GetInt("series_limit")
+	}
+
+	switch opts.Series {
+	case SeriesAll:
+		return metrics, allSeriesNote(metrics)
+	case SeriesTop:
+		return topSeries(metrics, limit, opts.SeriesRank)
+	case SeriesEnvelope:
+		return envelopeSeries(metrics)
+	case SeriesMatch:
+		if matched, ok := matchSeries(metrics, alert); ok {
+			return matched, matchedSeriesNote(metrics)
+		}
+		return metrics, fmt.Sprintf("no series match the alert, showing all %d", len(metrics))
+	case SeriesAuto, "":
+	default:
+		clog.Warnf("Unknown series strategy %s, using %s", opts.Series, SeriesAuto)
+	}
+
+	if matched, ok := matchSeries(metrics, alert); ok {
+		return matched, matchedSeriesNote(metrics)
+	}
+	clog.Infof("Best match not found. Labels to search: %v", alert.Labels)
+
+	switch {
+	case len(metrics) <= limit+1:
+		return metrics, allSeriesNote(metrics)
+	case len(metrics) > viper.GetInt("series_envelope_threshold"):
+		return envelopeSeries(metrics)
+	default:
+		return topSeries(metrics, limit, opts.SeriesRank)
+	}
+}
+
+// matchSeries finds the first series whose labels agree with the alert.
+func matchSeries(metrics model.Matrix, alert Alert) (model.Matrix, bool) {
+	for _, metric := range metrics {
+		clog.Infof("Metric fetched: %v", metric.Metric)
+		found := false
+		for label, value := range metric.Metric {
+			if originValue, ok := alert.Labels[string(label)]; ok {
+				if originValue == string(value) {
+					found = true
+				} else {
+					found = false
+					break
+				}
+			}
+		}
+
+		if found {
+			clog.Infof("Best match found: %v", metric.Metric)
+			return model.Matrix{metric}, true
+		}
+	}
+
+	return nil, false
+}
+
+func allSeriesNote(metrics model.Matrix) string {
+	return fmt.Sprintf("all %d series", len(metrics))
+}
+
+func matchedSeriesNote(metrics model.Matrix) string {
+	return fmt.Sprintf("series matching the alert, of %d", len(metrics))
+}
+
+// topSeries keeps the limit highest series by their peak or last value and
+// sums the rest into an "other" series.
+func topSeries(metrics model.Matrix, limit int, rank string) (model.Matrix, string) {
+	if len(metrics) <= limit {
+		return metrics, allSeriesNote(metrics)
+	}
+	if rank != "last" {
+		rank = "peak"
+	}
+
+	scores := make(map[*model.SampleStream]float64, len(metrics))
+	for _, sample := range metrics {
+		score := math.Inf(-1)
+		for _, v := range sample.Values {
+			f := float64(v.Value)
+			if math.IsNaN(f) {
+				continue
+			}
+			if rank == "last" || f > score {
+				score = f
+			}
+		}
+		scores[sample] = score
+	}
+
+	sorted := make(model.Matrix, len(metrics))
+	copy(sorted, metrics)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return scores[sorted[i]] > scores[sorted[j]]
+	})
+
+	selected := append(model.Matrix{}, sorted[:limit]...)
+	selected = append(selected, aggregateSeries(sorted[limit:], "other", seriesAggregates["other"]))
+
+	return selected, fmt.Sprintf("top %d of %d series by %s, rest summed as other", limit, len(metrics), rank)
+}
+
+// envelopeSeries replaces the series with their min, median and max.
+func envelopeSeries(metrics model.Matrix) (model.Matrix, string) {
+	envelope := model.Matrix{
+		aggregateSeries(metrics, "max", seriesAggregates["max"]),
+		aggregateSeries(metrics, "median", seriesAggregates["median"]),
+		aggregateSeries(metrics, "min", seriesAggregates["min"]),
+	}
+
+	return envelope, fmt.Sprintf("min/median/max of %d series", len(metrics))
+}
+
+// seriesAggregates are the series standing in for others, by name. Values
+// are passed sorted.
+var seriesAggregates = map[string]func([]float64) float64{
+	"other": func(values []float64) float64 {
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		return sum
+	},
+	"max": func(values []float64) float64 {
+		return values[len(values)-1]
+	},
+	"median": func(values []float64) float64 {
+		middle := len(values) / 2
+		if len(values)%2 == 0 {
+			return (values[middle-1] + values[middle]) / 2
+		}
+		return values[middle]
+	},
+	"min": func(values []float64) float64 {
+		return values[0]
+	},
+}
+
+// selectLike picks the series of metrics that stand for the selected ones:
+// the same series, and the same aggregates of the series left out, so that
+// the result of another query lines up with a selection made by
+// SelectSeries.
+func selectLike(metrics, selected model.Matrix) model.Matrix {
+	byFingerprint := make(map[model.Fingerprint]*model.SampleStream, len(metrics))
+	for _, sample := range metrics {
+		byFingerprint[sample.Metric.Fingerprint()] = sample
+	}
+
+	var result, aggregates model.Matrix
+	kept := make(map[model.Fingerprint]bool, len(selected))
+	for _, sample := range selected {
+		fingerprint := sample.Metric.Fingerprint()
+		if match, ok := byFingerprint[fingerprint]; ok {
+			kept[fingerprint] = true
+			result = append(result, match)
+			continue
+		}
+		if _, ok := seriesAggregates[string(sample.Metric["series"])]; ok && len(sample.Metric) == 1 {
+			aggregates = append(aggregates, sample)
+		}
+	}
+	if len(aggregates) == 0 {
+		return result
+	}
+
+	var rest model.Matrix
+	for _, sample := range metrics {
+		if !kept[sample.Metric.Fingerprint()] {
+			rest = append(rest, sample)
+		}
+	}
+	if len(rest) == 0 {
+		return result
+	}
+	for _, aggregate := range aggregates {
+		name := string(aggregate.Metric["series"])
+		result = append(result, aggregateSeries(rest, name, seriesAggregates[name]))
+	}
+
+	return result
+}
+
+// aggregateSeries combines the values of all series at each timestamp,
+// passing them sorted and without NaNs.
+func aggregateSeries(metrics model.Matrix, name string, aggregate func([]float64) float64) *model.SampleStream {
+	byTime := make(map[model.Time][]float64)
+	for _, sample := range metrics {
+		for _, v := range sample.Values {
+			if math.IsNaN(float64(v.Value)) {
+				continue
+			}
+			byTime[v.Timestamp] = append(byTime[v.Timestamp], float64(v.Value))
+		}
+	}
+
+	timestamps := make([]model.Time, 0, len(byTime))
+	for ts := range byTime {
+		timestamps = append(timestamps, ts)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	stream := &model.SampleStream{Metric: model.Metric{"series": model.LabelValue(name)}}
+	for _, ts := range timestamps {
+		values := byTime[ts]
+		sort.Float64s(values)
+		stream.Values = append(stream.Values, model.SamplePair{Timestamp: ts, Value: model.SampleValue(aggregate(values))})
+	}
+
+	return stream
+}
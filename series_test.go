@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/spf13/viper"
+)
+
+func TestSelectSeries(t *testing.T) {
+	viper.Set("series_limit", 2)
+	viper.Set("series_envelope_threshold", 5)
+
+	// instance i<n> peaks at n and ends at 0, except the last which ends at
+	// its peak
+	series := func(n int) model.Matrix {
+		var metrics model.Matrix
+		for i := 1; i <= n; i++ {
+			last := model.SampleValue(0)
+			if i == n {
+				last = model.SampleValue(i)
+			}
+			metrics = append(metrics, &model.SampleStream{
+				Metric: model.Metric{"job": "api", "instance": model.LabelValue(fmt.Sprintf("i%d", i))},
+				Values: []model.SamplePair{{Timestamp: 0, Value: model.SampleValue(i)}, {Timestamp: 60000, Value: last}},
+			})
+		}
+		return metrics
+	}
+	alert := func(labels KV) Alert { return Alert{Labels: labels} }
+
+	tests := []struct {
+		name          string
+		metrics       model.Matrix
+		alert         Alert
+		opts          PlotOptions
+		wantInstances []string
+		wantNote      string
+	}{
+		{
+			name:          "auto matching",
+			metrics:       series(4),
+			alert:         alert(KV{"alertname": "x", "instance": "i3"}),
+			wantInstances: []string{"i3"},
+			wantNote:      "series matching the alert, of 4",
+		},
+		{
+			name:          "auto within limit",
+			metrics:       series(3),
+			alert:         alert(KV{"instance": "other"}),
+			wantInstances: []string{"i1", "i2", "i3"},
+			wantNote:      "all 3 series",
+		},
+		{
+			name:          "auto top",
+			metrics:       series(4),
+			alert:         alert(KV{"instance": "other"}),
+			wantInstances: []string{"i4", "i3", ""},
+			wantNote:      "top 2 of 4 series by peak, rest summed as other",
+		},
+		{
+			name:          "auto envelope",
+			metrics:       series(6),
+			alert:         alert(KV{"instance": "other"}),
+			wantInstances: []string{"", "", ""},
+			wantNote:      "min/median/max of 6 series",
+		},
+		{
+			name:          "all",
+			metrics:       series(6),
+			alert:         alert(KV{"instance": "i1"}),
+			opts:          PlotOptions{Series: SeriesAll},
+			wantInstances: []string{"i1", "i2", "i3", "i4", "i5", "i6"},
+			wantNote:      "all 6 series",
+		},
+		{
+			name:          "match",
+			metrics:       series(3),
+			alert:         alert(KV{"instance": "i2"}),
+			opts:          PlotOptions{Series: SeriesMatch},
+			wantInstances: []string{"i2"},
+			wantNote:      "series matching the alert, of 3",
+		},
+		{
+			name:          "match without a match",
+			metrics:       series(3),
+			alert:         alert(KV{"instance": "other"}),
+			opts:          PlotOptions{Series: SeriesMatch},
+			wantInstances: []string{"i1", "i2", "i3"},
+			wantNote:      "no series match the alert, showing all 3",
+		},
+		{
+			name:          "top by last",
+			metrics:       series(4),
+			opts:          PlotOptions{Series: SeriesTop, SeriesRank: "last", SeriesLimit: 1},
+			wantInstances: []string{"i4", ""},
+			wantNote:      "top 1 of 4 series by last, rest summed as other",
+		},
+		{
+			name:          "top within limit",
+			metrics:       series(2),
+			opts:          PlotOptions{Series: SeriesTop},
+			wantInstances: []string{"i1", "i2"},
+			wantNote:      "all 2 series",
+		},
+		{
+			name:          "envelope",
+			metrics:       series(3),
+			opts:          PlotOptions{Series: SeriesEnvelope},
+			wantInstances: []string{"", "", ""},
+			wantNote:      "min/median/max of 3 series",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, note := SelectSeries(tt.metrics, tt.alert, tt.opts)
+			if note != tt.wantNote {
+				t.Errorf("SelectSeries() note = %q, want %q", note, tt.wantNote)
+			}
+			instances := make([]string, len(got))
+			for i, sample := range got {
+				instances[i] = string(sample.Metric["instance"])
+			}
+			if fmt.Sprint(instances) != fmt.Sprint(tt.wantInstances) {
+				t.Errorf("SelectSeries() instances = %q, want %q", instances, tt.wantInstances)
+			}
+		})
+	}
+}
+
+func TestEnvelopeSeries(t *testing.T) {
+	metrics := model.Matrix{
+		{Values: []model.SamplePair{{Timestamp: 0, Value: 1}}},
+		{Values: []model.SamplePair{{Timestamp: 0, Value: 4}}},
+		{Values: []model.SamplePair{{Timestamp: 0, Value: 2}}},
+		{Values: []model.SamplePair{{Timestamp: 0, Value: 10}}},
+	}
+
+	envelope, _ := envelopeSeries(metrics)
+	want := map[string]model.SampleValue{"max": 10, "median": 3, "min": 1}
+	for _, sample := range envelope {
+		name := string(sample.Metric["series"])
+		if len(sample.Values) != 1 || sample.Values[0].Value != want[name] {
+			t.Errorf("envelopeSeries() %s = %v, want %v", name, sample.Values, want[name])
+		}
+	}
+}
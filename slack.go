@@ -32,7 +32,7 @@ func SlackUpdateAlertMessage(token, channel, timestamp string, messageOptions ..
 	return respChannel, respTimestamp, err
 }
 
-func ComposeResolveUpdateBody(alert Alert, headerTemplate string, images ...SlackImage) ([]slack.Block, error) {
+func ComposeResolveUpdateBody(alert Alert, headerTemplate string, notes []string, images ...SlackImage) ([]slack.Block, error) {
 	headerTpl, e := ParseTemplate(headerTemplate, alert)
 	if e != nil {
 		return nil, e
@@ -51,6 +51,7 @@ func ComposeResolveUpdateBody(alert Alert, headerTemplate string, images ...Slac
 		imageAltText := "metric graph " + image.Title
 		blocks = append(blocks, slack.NewImageBlock(image.Url, truncateText(imageAltText, MAX_TEXT_LENGTH), "", textBlock))
 	}
+	blocks = append(blocks, composeNotes(notes)...)
 
 	return blocks, nil
 }
@@ -73,7 +74,7 @@ func ComposeUpdateFooter(alert Alert, footerTemplate string) ([]slack.Block, err
 	return blocks, nil
 }
 
-func ComposeMessageBody(alert Alert, messageTemplate, headerTemplate string, images ...SlackImage) ([]slack.Block, error) {
+func ComposeMessageBody(alert Alert, messageTemplate, headerTemplate string, notes []string, images ...SlackImage) ([]slack.Block, error) {
 	tpl, e := ParseTemplate(messageTemplate, alert)
 	if e != nil {
 		return nil, e
@@ -103,10 +104,27 @@ func ComposeMessageBody(alert Alert, messageTemplate, headerTemplate string, ima
 		imageAltText := "metric graph " + image.Title
 		blocks = append(blocks, slack.NewImageBlock(image.Url, truncateText(imageAltText, MAX_TEXT_LENGTH), "", textBlock))
 	}
+	blocks = append(blocks, composeNotes(notes)...)
 
 	return blocks, nil
 }
 
+// composeNotes explains missing or degraded graphs in a context block.
+func composeNotes(notes []string) []slack.Block {
+	if len(notes) == 0 {
+		return nil
+	}
+
+	notesBlock := slack.NewTextBlockObject(
+		"mrkdwn",
+		truncateText(":warning: "+strings.Join(notes, "\n:warning: "), MAX_TEXT_LENGTH),
+		false,
+		false,
+	)
+
+	return []slack.Block{slack.NewContextBlock("", notesBlock)}
+}
+
 func ParseTemplate(messageTemplate string, alert Alert) (bytes.Buffer, error) {
 	funcMap := template.FuncMap{
 		"toUpper": strings.ToUpper,
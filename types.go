@@ -28,9 +28,23 @@ type Alert struct {
 	EndsAt       time.Time   `json:"endsAt"`
 	GeneratorURL string      `json:"generatorURL" binding:"required"`
 	Fingerprint  string      `json:"fingerprint"`
+	Receiver     string
 	Channel      string
 	MessageTS    string
 	MessageBody  []slack.Block
+	Links        AlertLinks `json:"-"`
+	Datasource   Datasource `json:"-"`
+	// Rule is the alerting rule from the rules API, nil when not found
+	Rule *AlertRule `json:"-"`
+}
+
+// AlertLinks are links to investigate the alert in other tools, empty
+// when the tool isn't configured.
+type AlertLinks struct {
+	// Explore queries the alert expression over the graphed time range
+	Explore string
+	// Dashboard opens the dashboard panel linked to the alert
+	Dashboard string
 }
 
 type AlertStatus string
@@ -48,12 +62,28 @@ type SlackImage struct {
 	Title string `json:"title"`
 }
 
+// PlotExpr is a formula to graph and the threshold the alert compares it
+// against. Operator is one of "<", ">", "==", "!=" or empty when the
+// formula is drawn without a threshold.
 type PlotExpr struct {
 	Formula  string
 	Operator string
 	Level    float64
+	Unit     Unit
+	// Severity names the threshold when thresholds of other severities
+	// are drawn along with it
+	Severity string
+	// Siblings are the thresholds of the formula at other severities
+	Siblings []PlotExpr
+}
+
+func (expr PlotExpr) HasThreshold() bool {
+	return expr.Operator != ""
 }
 
 func (expr PlotExpr) String() string {
-	return fmt.Sprintf("%s %s %.2f", expr.Formula, expr.Operator, expr.Level)
+	if !expr.HasThreshold() {
+		return expr.Formula
+	}
+	return fmt.Sprintf("%s %s %s", expr.Formula, expr.Operator, FormatValue(expr.Level, expr.Unit))
 }
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/bugsnag/microkit/clog"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"gonum.org/v1/plot"
+)
+
+// Unit describes how plotted values are humanised.
+type Unit string
+
+const (
+	UnitNone           Unit = ""
+	UnitSeconds        Unit = "seconds"
+	UnitBytes          Unit = "bytes"
+	UnitBytesPerSecond Unit = "bytes_per_second"
+	UnitPerSecond      Unit = "per_second"
+	UnitRatio          Unit = "ratio"
+	UnitPercent        Unit = "percent"
+)
+
+// ParseUnit maps unit names used in annotations and Prometheus metadata,
+// including the OpenTelemetry spellings, to a Unit.
+func ParseUnit(name string) Unit {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "seconds", "second", "s":
+		return UnitSeconds
+	case "bytes", "byte", "by":
+		return UnitBytes
+	case "bytes_per_second", "bytes/s", "by/s", "bps":
+		return UnitBytesPerSecond
+	case "per_second", "/s", "ops", "rps":
+		return UnitPerSecond
+	case "ratio", "1":
+		return UnitRatio
+	case "percent", "%":
+		return UnitPercent
+	case "", "none", "short":
+		return UnitNone
+	default:
+		clog.Infof("Unknown unit: %s", name)
+		return UnitNone
+	}
+}
+
+// ResolveUnit picks the unit for a plotted formula: the alert's unit
+// annotation wins, then the metric name suffix, then Prometheus metadata.
+func (alert Alert) ResolveUnit(ctx context.Context, formula string, datasource Datasource) Unit {
+	if name, ok := alert.Annotations["unit"]; ok {
+		return ParseUnit(name)
+	}
+
+	expr, err := parser.ParseExpr(formula)
+	if err != nil {
+		return UnitNone
+	}
+
+	if unit := InferUnit(expr); unit != UnitNone {
+		return unit
+	}
+
+	selector := firstSelector(expr)
+	if selector == nil {
+		return UnitNone
+	}
+	name := baseMetricName(selectorName(selector))
+	metadata, err := MetricMetadata(ctx, datasource, name)
+	if err != nil {
+		clog.Warnf("Failed to fetch metadata for %s: %s", name, err.Error())
+		return UnitNone
+	}
+	for _, m := range metadata {
+		if m.Unit != "" {
+			return withRate(ParseUnit(m.Unit), isRated(expr, selector))
+		}
+	}
+
+	return UnitNone
+}
+
+// InferUnit guesses the unit of an expression from the suffixes of the
+// metric names it selects.
+func InferUnit(expr parser.Expr) Unit {
+	expr = unwrapParens(expr)
+
+	// x_sum / x_count and other ratios of like units
+	if binaryExpr, ok := expr.(*parser.BinaryExpr); ok && binaryExpr.Op == parser.DIV {
+		lhs, rhs := firstSelector(binaryExpr.LHS), firstSelector(binaryExpr.RHS)
+		if lhs != nil && rhs != nil {
+			lhsName, rhsName := selectorName(lhs), selectorName(rhs)
+			if strings.HasSuffix(lhsName, "_sum") && strings.HasSuffix(rhsName, "_count") {
+				return suffixUnit(baseMetricName(lhsName))
+			}
+			// both sides in the same known unit, rated counters being per
+			// second; values of unknown units may not be alike
+			if unit := InferUnit(binaryExpr.LHS); unit != UnitNone && unit == InferUnit(binaryExpr.RHS) {
+				return UnitRatio
+			}
+		}
+	}
+
+	selector := firstSelector(expr)
+	if selector == nil {
+		return UnitNone
+	}
+
+	name := selectorName(selector)
+	unit := suffixUnit(baseMetricName(name))
+	if strings.HasSuffix(name, "_bucket") {
+		// histogram_quantile returns values in the unit of the buckets
+		return unit
+	}
+
+	if isRated(expr, selector) {
+		if unit == UnitNone && !strings.HasSuffix(name, "_total") && !strings.HasSuffix(name, "_count") {
+			return UnitNone
+		}
+		return withRate(unit, true)
+	}
+
+	return unit
+}
+
+func suffixUnit(name string) Unit {
+	switch {
+	case strings.HasSuffix(name, "_seconds"):
+		return UnitSeconds
+	case strings.HasSuffix(name, "_bytes"):
+		return UnitBytes
+	case strings.HasSuffix(name, "_ratio"):
+		return UnitRatio
+	case strings.HasSuffix(name, "_percent"):
+		return UnitPercent
+	default:
+		return UnitNone
+	}
+}
+
+// withRate converts a counter unit to the unit of its per-second rate.
+func withRate(unit Unit, rated bool) Unit {
+	if !rated {
+		return unit
+	}
+
+	switch unit {
+	case UnitBytes:
+		return UnitBytesPerSecond
+	case UnitSeconds:
+		// seconds per second, e.g. CPU usage
+		return UnitNone
+	case UnitNone:
+		return UnitPerSecond
+	default:
+		return unit
+	}
+}
+
+// baseMetricName strips the series suffixes of counters and histograms.
+func baseMetricName(name string) string {
+	for _, suffix := range []string{"_bucket", "_sum", "_count", "_total", "_created"} {
+		if strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix)
+		}
+	}
+
+	return name
+}
+
+func firstSelector(expr parser.Expr) *parser.VectorSelector {
+	var selector *parser.VectorSelector
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		if vs, ok := node.(*parser.VectorSelector); ok && selector == nil {
+			selector = vs
+		}
+		return nil
+	})
+
+	return selector
+}
+
+func selectorName(selector *parser.VectorSelector) string {
+	if selector.Name != "" {
+		return selector.Name
+	}
+	for _, matcher := range selector.LabelMatchers {
+		if matcher.Name == labels.MetricName && matcher.Type == labels.MatchEqual {
+			return matcher.Value
+		}
+	}
+
+	return ""
+}
+
+// isRated reports whether the selector is wrapped in a per-second function.
+func isRated(expr parser.Expr, selector *parser.VectorSelector) bool {
+	var rated bool
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		if node != selector {
+			return nil
+		}
+		for _, parent := range path {
+			if call, ok := parent.(*parser.Call); ok {
+				switch call.Func.Name {
+				case "rate", "irate", "deriv":
+					rated = true
+				}
+			}
+		}
+		return nil
+	})
+
+	return rated
+}
+
+// FormatValue humanises a value with SI or IEC prefixes, durations or
+// percentages depending on its unit.
+func FormatValue(v float64, unit Unit) string {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return fmt.Sprintf("%v", v)
+	}
+
+	switch unit {
+	case UnitSeconds:
+		return formatDuration(v)
+	case UnitBytes:
+		return formatPrefixed(v, 1024, []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}, " ")
+	case UnitBytesPerSecond:
+		return formatPrefixed(v, 1024, []string{"B/s", "KiB/s", "MiB/s", "GiB/s", "TiB/s", "PiB/s"}, " ")
+	case UnitPerSecond:
+		return formatPrefixed(v, 1000, []string{"/s", "k/s", "M/s", "G/s", "T/s"}, "")
+	case UnitRatio:
+		return formatSignificant(v*100) + "%"
+	case UnitPercent:
+		return formatSignificant(v) + "%"
+	default:
+		if math.Abs(v) < 1000 {
+			return formatSignificant(v)
+		}
+		return formatPrefixed(v, 1000, []string{"", "k", "M", "G", "T", "P"}, "")
+	}
+}
+
+// formatPrefixed divides v by base until it fits the largest prefix.
+func formatPrefixed(v, base float64, prefixes []string, sep string) string {
+	i := 0
+	for math.Abs(v) >= base && i < len(prefixes)-1 {
+		v /= base
+		i++
+	}
+
+	return formatSignificant(v) + sep + prefixes[i]
+}
+
+func formatDuration(v float64) string {
+	abs := math.Abs(v)
+	switch {
+	case abs == 0:
+		return "0s"
+	case abs < 1e-6:
+		return formatSignificant(v*1e9) + "ns"
+	case abs < 1e-3:
+		return formatSignificant(v*1e6) + "µs"
+	case abs < 1:
+		return formatSignificant(v*1e3) + "ms"
+	case abs < 60:
+		return formatSignificant(v) + "s"
+	case abs < 3600:
+		return formatSignificant(v/60) + "m"
+	case abs < 86400:
+		return formatSignificant(v/3600) + "h"
+	default:
+		return formatSignificant(v/86400) + "d"
+	}
+}
+
+func formatSignificant(v float64) string {
+	return fmt.Sprintf("%.4g", v)
+}
+
+// unitTicks relabels the ticks of another ticker with humanised values.
+type unitTicks struct {
+	plot.Ticker
+	Unit Unit
+}
+
+func (t unitTicks) Ticks(min, max float64) []plot.Tick {
+	ticks := t.Ticker.Ticks(min, max)
+	for i := range ticks {
+		if ticks[i].Label != "" {
+			ticks[i].Label = FormatValue(ticks[i].Value, t.Unit)
+		}
+	}
+
+	return ticks
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func TestInferUnit(t *testing.T) {
+	tests := []struct {
+		formula string
+		want    Unit
+	}{
+		{formula: "node_memory_available_bytes", want: UnitBytes},
+		{formula: "rate(node_network_receive_bytes_total[5m])", want: UnitBytesPerSecond},
+		{formula: "rate(http_requests_total[5m])", want: UnitPerSecond},
+		{formula: "rate(process_cpu_seconds_total[5m])", want: UnitNone},
+		{formula: "rate(queue_length[5m])", want: UnitNone},
+		{formula: "histogram_quantile(0.99, rate(http_request_duration_seconds_bucket[5m]))", want: UnitSeconds},
+		{formula: "rate(http_request_duration_seconds_sum[5m]) / rate(http_request_duration_seconds_count[5m])", want: UnitSeconds},
+		{formula: "rate(http_errors_total[5m]) / rate(http_requests_total[5m])", want: UnitRatio},
+		{formula: "node_filesystem_free_bytes / node_filesystem_size_bytes", want: UnitRatio},
+		{formula: "(queue_length / queue_capacity)", want: UnitNone},
+		{formula: "node_filesystem_free_bytes / rate(http_requests_total[5m])", want: UnitBytes},
+		{formula: "cache_hit_ratio", want: UnitRatio},
+		{formula: "vector(1)", want: UnitNone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.formula, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tt.formula)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := InferUnit(expr); got != tt.want {
+				t.Errorf("InferUnit(%q) = %q, want %q", tt.formula, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	tests := []struct {
+		value float64
+		unit  Unit
+		want  string
+	}{
+		{value: 0.5, unit: UnitNone, want: "0.5"},
+		{value: 123.456, unit: UnitNone, want: "123.5"},
+		{value: 1500000, unit: UnitNone, want: "1.5M"},
+		{value: 0, unit: UnitSeconds, want: "0s"},
+		{value: 0.25, unit: UnitSeconds, want: "250ms"},
+		{value: 0.0002, unit: UnitSeconds, want: "200µs"},
+		{value: 90, unit: UnitSeconds, want: "1.5m"},
+		{value: 7200, unit: UnitSeconds, want: "2h"},
+		{value: 172800, unit: UnitSeconds, want: "2d"},
+		{value: 512, unit: UnitBytes, want: "512 B"},
+		{value: 1536, unit: UnitBytes, want: "1.5 KiB"},
+		{value: 3 * 1024 * 1024 * 1024, unit: UnitBytesPerSecond, want: "3 GiB/s"},
+		{value: 2500, unit: UnitPerSecond, want: "2.5k/s"},
+		{value: 0.125, unit: UnitRatio, want: "12.5%"},
+		{value: 99.9, unit: UnitPercent, want: "99.9%"},
+		{value: math.NaN(), unit: UnitBytes, want: "NaN"},
+		{value: math.Inf(1), unit: UnitSeconds, want: "+Inf"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := FormatValue(tt.value, tt.unit); got != tt.want {
+				t.Errorf("FormatValue(%v, %q) = %q, want %q", tt.value, tt.unit, got, tt.want)
+			}
+		})
+	}
+}